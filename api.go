@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/pkg/errors"
+)
+
+const defaultAPI = "localhost:5001"
+
+// newBackend returns the block store set with GIT_REMOTE_IPFS_STORE, the configured gateway or the api of the daemon
+func newBackend() (Backend, error) {
+	if dir := os.Getenv("GIT_REMOTE_IPFS_STORE"); dir != "" {
+		return newBlockStore(dir), nil
+	}
+	gateway, err := gatewayAddress()
+	if err != nil {
+		return nil, err
+	}
+	if gateway != "" {
+		log.Log("gateway", gateway, "event", "debug", "msg", "reading through gateway")
+		return newGatewayBackend(gateway)
+	}
+	addr, err := apiAddress()
+	if err != nil {
+		return nil, err
+	}
+	log.Log("api", addr, "event", "debug", "msg", "using daemon")
+	return dialAPI(addr)
+}
+
+// apiAddress finds the api of the daemon, the first one set of
+// 'git config remote.<name>.ipfsApi', 'git config ipfs.api', $IPFS_API and the api file of the daemon in $IPFS_PATH (~/.ipfs).
+// Without any of them it is localhost:5001.
+func apiAddress() (string, error) {
+	for _, key := range []string{"remote." + thisGitRemote + ".ipfsApi", "ipfs.api"} {
+		v, err := gitConfigGet(key)
+		if err != nil {
+			return "", err
+		}
+		if v != "" {
+			return v, nil
+		}
+	}
+	if v := os.Getenv("IPFS_API"); v != "" {
+		return v, nil
+	}
+	repo := os.Getenv("IPFS_PATH")
+	if repo == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return defaultAPI, nil
+		}
+		repo = filepath.Join(home, ".ipfs")
+	}
+	// written by the running daemon
+	api, err := ioutil.ReadFile(filepath.Join(repo, "api"))
+	if os.IsNotExist(err) {
+		return defaultAPI, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "reading the api file of the daemon failed")
+	}
+	return strings.TrimSpace(string(api)), nil
+}
+
+// dialAPI returns a Backend for the api at addr
+func dialAPI(addr string) (*shellBackend, error) {
+	network, url, err := parseAPIAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+	}
+	if network == "unix" {
+		socket := url
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		url = "http://unix"
+		return &shellBackend{sh: shell.NewShellWithClient(url, &http.Client{Transport: transport})}, nil
+	}
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	if strings.HasPrefix(url, "https://") {
+		if transport.TLSClientConfig, err = apiTLSConfig(url); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{Transport: &apiAuth{base: transport, url: url}}
+	return &shellBackend{sh: shell.NewShellWithClient(url, client)}, nil
+}
+
+// apiTLSConfig takes the tls settings for url from the http config of git:
+// http.sslCAInfo, http.sslVerify, http.sslCert and http.sslKey, overridden by $GIT_SSL_CAINFO, $GIT_SSL_NO_VERIFY,
+// $GIT_SSL_CERT and $GIT_SSL_KEY like git does.
+func apiTLSConfig(url string) (*tls.Config, error) {
+	setting := func(key, env string, flags ...string) (string, error) {
+		if v := os.Getenv(env); v != "" {
+			return v, nil
+		}
+		return gitConfigGetURL(key, url, flags...)
+	}
+	config := &tls.Config{}
+	caInfo, err := setting("http.sslCAInfo", "GIT_SSL_CAINFO", "--path")
+	if err != nil {
+		return nil, err
+	}
+	if caInfo != "" {
+		pem, err := ioutil.ReadFile(caInfo)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading the ca bundle failed")
+		}
+		// like curl, the bundle replaces the system roots
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in ca bundle %s", caInfo)
+		}
+	}
+	if os.Getenv("GIT_SSL_NO_VERIFY") != "" {
+		config.InsecureSkipVerify = true
+	} else {
+		verify, err := gitConfigGetURL("http.sslVerify", url, "--bool")
+		if err != nil {
+			return nil, err
+		}
+		config.InsecureSkipVerify = verify == "false"
+	}
+	cert, err := setting("http.sslCert", "GIT_SSL_CERT", "--path")
+	if err != nil {
+		return nil, err
+	}
+	if cert != "" {
+		key, err := setting("http.sslKey", "GIT_SSL_KEY", "--path")
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			key = cert
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading the client certificate failed")
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// apiAuth authenticates requests to an api behind a proxy that wants credentials.
+// The first time the api answers 401 the credentials for its url are asked with 'git credential fill'
+// and the request is repeated with them. Depending on the challenge they are sent as basic auth or
+// the password as bearer token, unless the credential helper returns a complete authtype and credential.
+type apiAuth struct {
+	base http.RoundTripper
+	url  string
+
+	mu       sync.Mutex
+	cred     []string // as returned by 'git credential fill', nil until asked
+	header   string   // Authorization header made from cred
+	approved bool
+}
+
+func (a *apiAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	a.mu.Lock()
+	header := a.header
+	a.mu.Unlock()
+	if header == "" {
+		resp, err := a.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		// the body was already sent
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		challenges := resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")]
+		if header, err = a.fill(challenges); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+	authReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		authReq.Body = body
+	}
+	authReq.Header.Set("Authorization", header)
+	resp, err := a.base.RoundTrip(authReq)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verdict(header, resp.StatusCode != http.StatusUnauthorized); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fill asks git for the credentials of the api
+func (a *apiAuth) fill(challenges []string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.header != "" {
+		// another request asked already
+		return a.header, nil
+	}
+	in := []string{"capability[]=authtype", "url=" + a.url}
+	for _, c := range challenges {
+		in = append(in, "wwwauth[]="+c)
+	}
+	cred, err := gitCredential("fill", in)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting credentials for the api at %s failed", a.url)
+	}
+	fields := make(map[string]string)
+	for _, l := range cred {
+		if i := strings.Index(l, "="); i > 0 {
+			fields[l[:i]] = l[i+1:]
+		}
+	}
+	switch {
+	case fields["authtype"] != "" && fields["credential"] != "":
+		a.header = fields["authtype"] + " " + fields["credential"]
+	case wantsBearer(challenges):
+		a.header = "Bearer " + fields["password"]
+	default:
+		basic := base64.StdEncoding.EncodeToString([]byte(fields["username"] + ":" + fields["password"]))
+		a.header = "Basic " + basic
+	}
+	a.cred = cred
+	log.Log("event", "debug", "api", a.url, "user", fields["username"], "msg", "authenticating api requests")
+	return a.header, nil
+}
+
+// verdict tells the credential helpers whether the credentials sent as header were accepted.
+// Rejected ones are forgotten, so the next request asks for new ones.
+func (a *apiAuth) verdict(header string, ok bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rejected := errors.Errorf("the api at %s rejected the credentials", a.url)
+	if header != a.header {
+		// another request already rejected them
+		if ok {
+			return nil
+		}
+		return rejected
+	}
+	if ok && a.approved {
+		return nil
+	}
+	if ok {
+		a.approved = true
+		_, err := gitCredential("approve", a.cred)
+		return err
+	}
+	cred := a.cred
+	a.cred, a.header, a.approved = nil, "", false
+	if _, err := gitCredential("reject", cred); err != nil {
+		return err
+	}
+	return rejected
+}
+
+// wantsBearer reports whether the api only accepts bearer tokens
+func wantsBearer(challenges []string) bool {
+	for _, c := range challenges {
+		if strings.HasPrefix(strings.ToLower(c), "basic") {
+			return false
+		}
+	}
+	for _, c := range challenges {
+		if strings.HasPrefix(strings.ToLower(c), "bearer") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAPIAddr returns the network and the url of addr: host:port, a url or a multiaddr like /ip4/127.0.0.1/tcp/5001,
+// /dns/ipfs.example.com/tcp/443/https or /unix/run/ipfs.sock. For unix sockets the url is the path of the socket.
+func parseAPIAddr(addr string) (string, string, error) {
+	if !strings.HasPrefix(addr, "/") {
+		return "tcp", addr, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(addr, "/"), "/")
+	if parts[0] == "unix" && len(parts) > 1 {
+		return "unix", "/" + strings.Join(parts[1:], "/"), nil
+	}
+	if len(parts) < 4 || parts[2] != "tcp" {
+		return "", "", errors.Errorf("unsupported api address %q", addr)
+	}
+	host := parts[1]
+	switch parts[0] {
+	case "ip4", "dns", "dns4", "dns6":
+	case "ip6":
+		host = "[" + host + "]"
+	default:
+		return "", "", errors.Errorf("unsupported api address %q", addr)
+	}
+	scheme := "http"
+	switch rest := strings.Join(parts[4:], "/"); rest {
+	case "", "http":
+	case "https", "tls/http":
+		scheme = "https"
+	default:
+		return "", "", errors.Errorf("unsupported api address %q", addr)
+	}
+	return "tcp", scheme + "://" + host + ":" + parts[3], nil
+}
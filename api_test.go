@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cryptix/go/logging"
+	"github.com/cryptix/go/logging/logtest"
+)
+
+func TestParseAPIAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr, network, url string
+	}{
+		{"localhost:5001", "tcp", "localhost:5001"},
+		{"https://ipfs.example.com", "tcp", "https://ipfs.example.com"},
+		{"/ip4/127.0.0.1/tcp/5001", "tcp", "http://127.0.0.1:5001"},
+		{"/ip6/::1/tcp/5001", "tcp", "http://[::1]:5001"},
+		{"/dns/ipfs.example.com/tcp/443/https", "tcp", "https://ipfs.example.com:443"},
+		{"/dns4/ipfs.example.com/tcp/5001/http", "tcp", "http://ipfs.example.com:5001"},
+		{"/unix/run/ipfs/api.sock", "unix", "/run/ipfs/api.sock"},
+		{"/ip4/127.0.0.1/udp/5001", "", ""},
+		{"/onion3/xyz/tcp/5001", "", ""},
+		{"/ip4/127.0.0.1/tcp/5001/ws", "", ""},
+	} {
+		network, url, err := parseAPIAddr(tc.addr)
+		if tc.network == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s %s", tc.addr, network, url)
+			}
+			continue
+		}
+		checkFatal(t, err)
+		if network != tc.network || url != tc.url {
+			t.Errorf("%s: got %s %s, want %s %s", tc.addr, network, url, tc.network, tc.url)
+		}
+	}
+}
+
+func TestAPIAddress(t *testing.T) {
+	git, err := exec.LookPath("git")
+	checkFatal(t, err)
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+	checkFatal(t, exec.Command(git, "init", "-q", tmpDir).Run())
+	ipfsPath := filepath.Join(tmpDir, "ipfs")
+	checkFatal(t, os.Mkdir(ipfsPath, 0700))
+
+	defer func(repo, remote string) { thisGitRepo, thisGitRemote = repo, remote }(thisGitRepo, thisGitRemote)
+	thisGitRepo, thisGitRemote = filepath.Join(tmpDir, ".git"), "origin"
+	for _, env := range []string{"IPFS_PATH", "IPFS_API"} {
+		defer func(env, v string) { os.Setenv(env, v) }(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	checkFatal(t, os.Setenv("IPFS_PATH", ipfsPath))
+
+	// each one wins over the ones before
+	steps := []struct {
+		set  func()
+		want string
+	}{
+		{func() {}, defaultAPI},
+		{func() {
+			checkFatal(t, ioutil.WriteFile(filepath.Join(ipfsPath, "api"), []byte("/ip4/127.0.0.1/tcp/5002\n"), 0600))
+		}, "/ip4/127.0.0.1/tcp/5002"},
+		{func() { checkFatal(t, os.Setenv("IPFS_API", "/ip4/127.0.0.1/tcp/5003")) }, "/ip4/127.0.0.1/tcp/5003"},
+		{func() {
+			checkFatal(t, exec.Command(git, "-C", tmpDir, "config", "ipfs.api", "/unix/tmp/api.sock").Run())
+		}, "/unix/tmp/api.sock"},
+		{func() {
+			checkFatal(t, exec.Command(git, "-C", tmpDir, "config", "remote.origin.ipfsApi", "localhost:5004").Run())
+		}, "localhost:5004"},
+	}
+	for i, step := range steps {
+		step.set()
+		got, err := apiAddress()
+		checkFatal(t, err)
+		if got != step.want {
+			t.Errorf("step %d: got %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestDialAPI_auth(t *testing.T) {
+	git, err := exec.LookPath("git")
+	checkFatal(t, err)
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+	checkFatal(t, exec.Command(git, "init", "-q", tmpDir).Run())
+	defer func(repo, remote string) { thisGitRepo, thisGitRemote = repo, remote }(thisGitRepo, thisGitRemote)
+	thisGitRepo, thisGitRemote = filepath.Join(tmpDir, ".git"), "origin"
+	defer func(l logging.Interface) { log = l }(log)
+	log, _ = logtest.KitLogger("TestDialAPI_auth", t)
+	for _, env := range []string{"GIT_SSL_CAINFO", "GIT_SSL_NO_VERIFY", "GIT_SSL_CERT", "GIT_SSL_KEY"} {
+		defer func(env, v string) { os.Setenv(env, v) }(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	config := func(args ...string) {
+		checkFatal(t, exec.Command(git, append([]string{"-C", tmpDir, "config"}, args...)...).Run())
+	}
+
+	var challenge, want string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != want {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(tmpDir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	checkFatal(t, ioutil.WriteFile(caFile, ca, 0600))
+
+	// without the ca of the server
+	b, err := dialAPI(srv.URL)
+	checkFatal(t, err)
+	if _, err := b.Cat("/ipfs/x"); err == nil {
+		t.Fatal("expected an unknown authority error")
+	}
+	config("http.sslCAInfo", caFile)
+
+	actions := filepath.Join(tmpDir, "actions")
+	config("credential.helper", `!f() { echo $1 >> `+actions+`; test $1 = get && printf "username=u\npassword=secret\n"; }; f`)
+	for _, tc := range []struct {
+		challenge, want string
+		ok              bool
+		actions         string
+	}{
+		{`Basic realm="ipfs"`, "Basic " + base64.StdEncoding.EncodeToString([]byte("u:secret")), true, "get store"},
+		{`Bearer realm="ipfs"`, "Bearer secret", true, "get store"},
+		// rejected credentials aren't sent again, the next request asks for new ones
+		{`Basic realm="ipfs"`, "Basic wrong", false, "get erase get erase"},
+	} {
+		challenge, want = tc.challenge, tc.want
+		checkFatal(t, ioutil.WriteFile(actions, nil, 0600))
+		b, err := dialAPI(srv.URL)
+		checkFatal(t, err)
+		for i := 0; i < 2; i++ {
+			rc, err := b.Cat("/ipfs/x")
+			if !tc.ok {
+				if err == nil {
+					t.Errorf("%s: expected rejected credentials", tc.challenge)
+				}
+				continue
+			}
+			checkFatal(t, err)
+			data, err := ioutil.ReadAll(rc)
+			checkFatal(t, err)
+			checkFatal(t, rc.Close())
+			if string(data) != "hello" {
+				t.Errorf("%s: got %q", tc.challenge, data)
+			}
+		}
+		got, err := ioutil.ReadFile(actions)
+		checkFatal(t, err)
+		if strings.Join(strings.Fields(string(got)), " ") != tc.actions {
+			t.Errorf("%s: credential helper was called for %q, want %q", tc.challenge, got, tc.actions)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/pkg/errors"
+)
+
+// Backend is the content addressed storage a remote lives in.
+// Paths are unixfs paths like /ipfs/<cid>/repo.git/HEAD, directories are plain unixfs dag-pb nodes.
+type Backend interface {
+	// Cat reads the file at p
+	Cat(p string) (io.ReadCloser, error)
+	// CatRange reads length bytes of the file at p from offset on, a negative length reads until the end
+	CatRange(p string, offset, length int64) (io.ReadCloser, error)
+	// List returns the entries of the directory at p
+	List(p string) ([]*shell.LsLink, error)
+	// ResolvePath returns the cid p points to
+	ResolvePath(p string) (string, error)
+	// Add stores a file and returns its cid and cumulative size, with onlyHash it is only hashed
+	Add(r io.Reader, onlyHash bool) (string, uint64, error)
+	// GetDir returns the directory node hash
+	GetDir(hash string) (*shell.IpfsObject, error)
+	// PutDir stores a directory node and returns its cid and cumulative size
+	PutDir(node *shell.IpfsObject) (string, uint64, error)
+	// Size returns the cumulative size of hash, which links to it need
+	Size(hash string) (uint64, error)
+	// ResolveName returns the path an ipns name points to now, without any caching
+	ResolveName(name string) (string, error)
+	// Publish points the ipns name of key to p
+	Publish(p, key string) error
+	// Keys returns the keys that can publish names
+	Keys() ([]backendKey, error)
+	// Block returns the raw block c
+	Block(c string) ([]byte, error)
+}
+
+// backendKey is a key for publishing, the id is the name it publishes
+type backendKey struct {
+	Name string
+	Id   string
+}
+
+var (
+	// errNotExist is the cause of errors for paths that don't exist
+	errNotExist = errors.New("no such file or directory")
+
+	errReadOnly = errors.New("the remote is read-only, pushing needs a daemon")
+)
+
+// shellBackend talks to the http api of an ipfs daemon, see dialAPI
+type shellBackend struct {
+	sh *shell.Shell
+}
+
+func (b *shellBackend) Cat(p string) (io.ReadCloser, error) {
+	return b.sh.Cat(p)
+}
+
+func (b *shellBackend) CatRange(p string, offset, length int64) (io.ReadCloser, error) {
+	req := b.sh.Request("cat", p).Option("offset", offset)
+	if length >= 0 {
+		req.Option("length", length)
+	}
+	resp, err := req.Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		resp.Close()
+		return nil, resp.Error
+	}
+	return resp.Output, nil
+}
+
+func (b *shellBackend) List(p string) ([]*shell.LsLink, error) {
+	return b.sh.List(p)
+}
+
+func (b *shellBackend) ResolvePath(p string) (string, error) {
+	return b.sh.ResolvePath(p)
+}
+
+// Add is shell.Add that also returns the cumulative size of the added file
+func (b *shellBackend) Add(r io.Reader, onlyHash bool) (string, uint64, error) {
+	fr := files.NewReaderFile(r)
+	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", fr)})
+	var out struct {
+		Hash string
+		Size string
+	}
+	req := b.sh.Request("add").Body(files.NewMultiFileReader(slf, true))
+	if onlyHash {
+		req.Option("only-hash", true)
+	}
+	if err := req.Exec(context.Background(), &out); err != nil {
+		return "", 0, err
+	}
+	size, err := strconv.ParseUint(out.Size, 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "add: illegal size %q", out.Size)
+	}
+	return out.Hash, size, nil
+}
+
+func (b *shellBackend) GetDir(hash string) (*shell.IpfsObject, error) {
+	return b.sh.ObjectGet(hash)
+}
+
+func (b *shellBackend) PutDir(node *shell.IpfsObject) (string, uint64, error) {
+	hash, err := b.sh.ObjectPut(node)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "objectPut failed")
+	}
+	size, err := b.Size(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+func (b *shellBackend) Size(hash string) (uint64, error) {
+	stat, err := b.sh.ObjectStat(hash)
+	if err != nil {
+		return 0, errors.Wrapf(err, "objectStat(%s) failed", hash)
+	}
+	return uint64(stat.CumulativeSize), nil
+}
+
+func (b *shellBackend) ResolveName(name string) (string, error) {
+	var out struct{ Path string }
+	err := b.sh.Request("name/resolve", name).Option("nocache", true).Exec(context.Background(), &out)
+	return out.Path, err
+}
+
+func (b *shellBackend) Publish(p, key string) error {
+	_, err := b.sh.PublishWithDetails(p, key, 0, 0, false)
+	return err
+}
+
+func (b *shellBackend) Keys() ([]backendKey, error) {
+	var out struct{ Keys []backendKey }
+	if err := b.sh.Request("key/list").Exec(context.Background(), &out); err != nil {
+		return nil, err
+	}
+	return out.Keys, nil
+}
+
+func (b *shellBackend) Block(c string) ([]byte, error) {
+	return b.sh.BlockGet(c)
+}
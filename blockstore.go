@@ -0,0 +1,535 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+// blockStore is a Backend without a daemon, for tests and for repos that don't need to leave the machine.
+// The blocks are kept in memory or as files in a directory, see GIT_REMOTE_IPFS_STORE.
+// Files are chunked like 'ipfs add' does by default, so the cids are the ones a daemon would return.
+// Names are only known to the store, the ids of its keys are made up from the key names.
+type blockStore struct {
+	dir string // empty keeps everything in memory
+	mu  sync.Mutex
+	mem map[string][]byte // <kind>/<name> -> data
+
+	// fetch gets blocks the store doesn't have, nil if it has all of them
+	fetch func(c string) ([]byte, error)
+	// cacheFetched keeps fetched blocks, for sources that are slower than memory is scarce
+	cacheFetched bool
+}
+
+func newBlockStore(dir string) *blockStore {
+	return &blockStore{dir: dir, mem: make(map[string][]byte)}
+}
+
+const (
+	unixfsDirType  = 1
+	unixfsFileType = 2
+
+	// the defaults of 'ipfs add': chunks of 256KiB in a balanced tree of nodes with up to 174 links
+	addChunkSize = 256 << 10
+	addMaxLinks  = 174
+
+	// emptyDirCid is the empty unixfs directory, which every store has
+	emptyDirCid = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
+)
+
+func (s *blockStore) Cat(p string) (io.ReadCloser, error) {
+	return s.CatRange(p, 0, -1)
+}
+
+func (s *blockStore) CatRange(p string, offset, length int64) (io.ReadCloser, error) {
+	c, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := catFile(c, offset, length, s.Block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s failed", p)
+	}
+	return rc, nil
+}
+
+func (s *blockStore) List(p string) ([]*shell.LsLink, error) {
+	c, err := s.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	node, _, err := s.node(c)
+	if err != nil {
+		return nil, err
+	}
+	if typ, _, _, err := decodeUnixfs(node.Data); err != nil || typ != unixfsDirType {
+		return nil, errors.Errorf("%s is not a directory", p)
+	}
+	var links []*shell.LsLink
+	for _, l := range node.Links {
+		typ := uint64(unixfsFileType)
+		if !isRawCid(l.Hash) {
+			child, _, err := s.node(l.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if typ, _, _, err = decodeUnixfs(child.Data); err != nil {
+				return nil, errors.Wrapf(err, "%s/%s is not unixfs", p, l.Name)
+			}
+		}
+		links = append(links, &shell.LsLink{Hash: l.Hash, Name: l.Name, Size: l.Size, Type: int(typ)})
+	}
+	return links, nil
+}
+
+func (s *blockStore) ResolvePath(p string) (string, error) {
+	return s.resolve(p)
+}
+
+func (s *blockStore) Add(r io.Reader, onlyHash bool) (string, uint64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "add: reading file failed")
+	}
+	chunks := [][]byte{data}
+	for len(chunks[len(chunks)-1]) > addChunkSize {
+		last := chunks[len(chunks)-1]
+		chunks = append(chunks[:len(chunks)-1], last[:addChunkSize], last[addChunkSize:])
+	}
+	depth := 0
+	for width := 1; width < len(chunks); width *= addMaxLinks {
+		depth++
+	}
+	c, size, _, err := s.addChunks(chunks, depth, onlyHash)
+	return c, size, err
+}
+
+// addChunks stores the chunks as a balanced tree of the given depth
+// and returns its cid, cumulative size and the size of the file data in it
+func (s *blockStore) addChunks(chunks [][]byte, depth int, onlyHash bool) (string, uint64, uint64, error) {
+	if depth == 0 {
+		node := &shell.IpfsObject{Data: encodeUnixfsFile(chunks[0], uint64(len(chunks[0])), nil)}
+		c, size, err := s.put(node, onlyHash)
+		return c, size, uint64(len(chunks[0])), err
+	}
+	per := 1
+	for i := 1; i < depth; i++ {
+		per *= addMaxLinks
+	}
+	var (
+		node       shell.IpfsObject
+		blockSizes []uint64
+		fileSize   uint64
+	)
+	for i := 0; i < len(chunks); i += per {
+		end := i + per
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		c, size, childSize, err := s.addChunks(chunks[i:end], depth-1, onlyHash)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		node.Links = append(node.Links, shell.ObjectLink{Hash: c, Size: size})
+		blockSizes = append(blockSizes, childSize)
+		fileSize += childSize
+	}
+	node.Data = encodeUnixfsFile(nil, fileSize, blockSizes)
+	c, size, err := s.put(&node, onlyHash)
+	return c, size, fileSize, err
+}
+
+func (s *blockStore) GetDir(hash string) (*shell.IpfsObject, error) {
+	node, _, err := s.node(hash)
+	return node, err
+}
+
+func (s *blockStore) PutDir(node *shell.IpfsObject) (string, uint64, error) {
+	return s.put(node, false)
+}
+
+func (s *blockStore) Size(hash string) (uint64, error) {
+	node, block, err := s.node(hash)
+	if err != nil {
+		return 0, err
+	}
+	return cumulativeSize(block, node), nil
+}
+
+func (s *blockStore) ResolveName(name string) (string, error) {
+	p, ok, err := s.read("names", name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.Errorf("could not resolve name %s", name)
+	}
+	return string(p), nil
+}
+
+func (s *blockStore) Publish(p, key string) error {
+	if key == "" || strings.ContainsAny(key, `/\`) {
+		return errors.Errorf("illegal key name %q", key)
+	}
+	id, err := storeKeyID(key)
+	if err != nil {
+		return err
+	}
+	if err := s.write("keys", key, []byte(id)); err != nil {
+		return err
+	}
+	return s.write("names", id, []byte(p))
+}
+
+// Keys returns self and every key that published before
+func (s *blockStore) Keys() ([]backendKey, error) {
+	names, err := s.list("keys")
+	if err != nil {
+		return nil, err
+	}
+	if i := sort.SearchStrings(names, "self"); i == len(names) || names[i] != "self" {
+		names = append([]string{"self"}, names...)
+	}
+	var keys []backendKey
+	for _, name := range names {
+		id, err := storeKeyID(name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, backendKey{Name: name, Id: id})
+	}
+	return keys, nil
+}
+
+// readOnlyStore is a blockStore that gets its blocks from somewhere that can't be pushed to, see blockStore.fetch
+type readOnlyStore struct {
+	*blockStore
+}
+
+func (s readOnlyStore) ResolveName(name string) (string, error) {
+	return "", errors.Errorf("can't resolve /ipns/%s without a daemon, names can't be verified", name)
+}
+
+// Add only hashes, for dry runs
+func (s readOnlyStore) Add(r io.Reader, onlyHash bool) (string, uint64, error) {
+	if !onlyHash {
+		return "", 0, errReadOnly
+	}
+	return s.blockStore.Add(r, true)
+}
+
+func (s readOnlyStore) PutDir(*shell.IpfsObject) (string, uint64, error) {
+	return "", 0, errReadOnly
+}
+
+func (s readOnlyStore) Publish(p, key string) error {
+	return errReadOnly
+}
+
+func (s readOnlyStore) Keys() ([]backendKey, error) {
+	return nil, errReadOnly
+}
+
+// storeKeyID makes up the id of a key of the store
+func storeKeyID(key string) (string, error) {
+	mh, err := multihash.Sum([]byte("git-remote-ipfs store key "+key), multihash.SHA2_256, -1)
+	if err != nil {
+		return "", errors.Wrapf(err, "hashing key %s failed", key)
+	}
+	return mh.B58String(), nil
+}
+
+// resolve follows p to the cid it points to
+func (s *blockStore) resolve(p string) (string, error) {
+	parts := splitPath(p)
+	if len(parts) > 0 && parts[0] == "ipns" {
+		if len(parts) < 2 {
+			return "", errors.Errorf("illegal path %q", p)
+		}
+		target, err := s.ResolveName(parts[1])
+		if err != nil {
+			return "", err
+		}
+		return s.resolve(path.Join(append([]string{target}, parts[2:]...)...))
+	}
+	if len(parts) > 0 && parts[0] == "ipfs" {
+		parts = parts[1:]
+	}
+	if len(parts) == 0 {
+		return "", errors.Errorf("illegal path %q", p)
+	}
+	c := parts[0]
+	if _, err := cid.Decode(c); err != nil {
+		return "", errors.Wrapf(err, "illegal cid in %q", p)
+	}
+	for _, name := range parts[1:] {
+		node, _, err := s.node(c)
+		if err != nil {
+			return "", err
+		}
+		next := ""
+		for _, l := range node.Links {
+			if l.Name == name {
+				next = l.Hash
+				break
+			}
+		}
+		if next == "" {
+			return "", errors.Wrapf(errNotExist, "no link named %q under %s", name, c)
+		}
+		c = next
+	}
+	return c, nil
+}
+
+// catFile returns a reader for length bytes of the unixfs file c from offset on, a negative length reads until the end.
+// The blocks are got with block while reading, only one leaf at a time is in memory.
+func catFile(c string, offset, length int64, block func(c string) ([]byte, error)) (io.ReadCloser, error) {
+	// the first block is checked before, so that missing files fail here and not while reading
+	root, err := block(c)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		f := &fileWalk{w: pw, block: block, offset: offset, length: length}
+		pw.CloseWithError(errors.Wrapf(f.walkBlock(c, root), "reading %s failed", c))
+	}()
+	return pr, nil
+}
+
+// fileWalk writes the parts of a unixfs file depth first
+type fileWalk struct {
+	w      io.Writer
+	block  func(c string) ([]byte, error)
+	offset int64 // still to skip
+	length int64 // still to write, negative for everything
+}
+
+func (f *fileWalk) walk(c string) error {
+	block, err := f.block(c)
+	if err != nil {
+		return err
+	}
+	return f.walkBlock(c, block)
+}
+
+// walkBlock writes the part of the file in block c and its links.
+// Links before offset are skipped by their block sizes without reading them.
+func (f *fileWalk) walkBlock(c string, block []byte) error {
+	if isRawCid(c) {
+		return f.take(block)
+	}
+	node, err := decodeDagPB(block)
+	if err != nil {
+		return errors.Wrapf(err, "block %s", c)
+	}
+	typ, content, sizes, err := decodeUnixfs(node.Data)
+	if err != nil {
+		return errors.Wrapf(err, "%s is not unixfs", c)
+	}
+	if typ == unixfsDirType {
+		return errors.Errorf("%s is a directory", c)
+	}
+	if err := f.take(content); err != nil {
+		return err
+	}
+	for i, l := range node.Links {
+		if f.length == 0 {
+			break
+		}
+		// without sizes the part has to be read to know how much of offset it covers
+		if len(sizes) == len(node.Links) && f.offset >= int64(sizes[i]) {
+			f.offset -= int64(sizes[i])
+			continue
+		}
+		if err := f.walk(l.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// take writes what is left of part after offset, up to length
+func (f *fileWalk) take(part []byte) error {
+	if f.offset >= int64(len(part)) {
+		f.offset -= int64(len(part))
+		return nil
+	}
+	part = part[f.offset:]
+	f.offset = 0
+	if f.length >= 0 && int64(len(part)) > f.length {
+		part = part[:f.length]
+	}
+	n, err := f.w.Write(part)
+	if f.length >= 0 {
+		f.length -= int64(n)
+	}
+	return err
+}
+
+// Block returns the block c, fetching it if the store doesn't have it
+func (s *blockStore) Block(c string) ([]byte, error) {
+	block, ok, err := s.read("blocks", c)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return block, nil
+	}
+	if c == emptyDirCid {
+		return encodeDagPB(&shell.IpfsObject{Data: unixfsDirData})
+	}
+	if s.fetch == nil {
+		return nil, errors.Errorf("block %s not found", c)
+	}
+	if block, err = s.fetch(c); err != nil {
+		return nil, err
+	}
+	if !s.cacheFetched {
+		return block, nil
+	}
+	if err := s.write("blocks", c, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// isRawCid reports whether c is a raw block, the leaves of files added with --raw-leaves or as cidv1
+func isRawCid(c string) bool {
+	parsed, err := cid.Decode(c)
+	return err == nil && parsed.Type() == cid.Raw
+}
+
+// node returns the decoded dag-pb node c and its block
+func (s *blockStore) node(c string) (*shell.IpfsObject, []byte, error) {
+	block, err := s.Block(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	node, err := decodeDagPB(block)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "block %s", c)
+	}
+	return node, block, nil
+}
+
+// put stores node as block and returns its cid and cumulative size, with onlyHash it is only hashed
+func (s *blockStore) put(node *shell.IpfsObject, onlyHash bool) (string, uint64, error) {
+	block, err := encodeDagPB(node)
+	if err != nil {
+		return "", 0, err
+	}
+	c, err := blockCid(block)
+	if err != nil {
+		return "", 0, err
+	}
+	if !onlyHash {
+		if err := s.write("blocks", c, block); err != nil {
+			return "", 0, err
+		}
+	}
+	return c, cumulativeSize(block, node), nil
+}
+
+func (s *blockStore) read(kind, name string) ([]byte, bool, error) {
+	if s.dir == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		data, ok := s.mem[kind+"/"+name]
+		return data, ok, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, kind, name))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "reading %s %s failed", kind, name)
+	}
+	return data, true, nil
+}
+
+func (s *blockStore) write(kind, name string, data []byte) error {
+	if s.dir == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.mem[kind+"/"+name] = data
+		return nil
+	}
+	dir := filepath.Join(s.dir, kind)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "creating %s failed", dir)
+	}
+	return writeFileAtomic(filepath.Join(dir, name), data)
+}
+
+// list returns the sorted names of one kind
+func (s *blockStore) list(kind string) ([]string, error) {
+	var names []string
+	if s.dir == "" {
+		s.mu.Lock()
+		for k := range s.mem {
+			if strings.HasPrefix(k, kind+"/") {
+				names = append(names, strings.TrimPrefix(k, kind+"/"))
+			}
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		return names, nil
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, kind))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", kind)
+	}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+// encodeUnixfsFile returns the unixfs data of a file node: type (1), data (2), file size (3) and the sizes of the linked parts (4)
+func encodeUnixfsFile(data []byte, fileSize uint64, blockSizes []uint64) string {
+	b := appendPBVarint(nil, 1, unixfsFileType)
+	if len(data) > 0 {
+		b = appendPBBytes(b, 2, data)
+	}
+	b = appendPBVarint(b, 3, fileSize)
+	for _, size := range blockSizes {
+		b = appendPBVarint(b, 4, size)
+	}
+	return string(b)
+}
+
+// decodeUnixfs returns the type, the data and the sizes of the linked parts of the unixfs data of a node
+func decodeUnixfs(data string) (uint64, []byte, []uint64, error) {
+	var (
+		typ        uint64
+		content    []byte
+		blockSizes []uint64
+	)
+	err := readPBFields([]byte(data), func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			typ = v
+		case 2:
+			content = append([]byte(nil), data...)
+		case 4:
+			blockSizes = append(blockSizes, v)
+		}
+		return nil
+	})
+	return typ, content, blockSizes, err
+}
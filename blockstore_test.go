@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+func TestBlockStore_add(t *testing.T) {
+	s := newBlockStore("")
+	big := make([]byte, 3*addChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(big)
+	for _, tc := range []struct {
+		data []byte
+		want string
+		size uint64
+	}{
+		// the same as 'ipfs add'
+		{[]byte("hello world\n"), "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", 20},
+		{nil, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", 6},
+		{big, "", 0},
+	} {
+		hash, size, err := s.Add(bytes.NewReader(tc.data), false)
+		checkFatal(t, err)
+		if tc.want != "" && (hash != tc.want || size != tc.size) {
+			t.Errorf("add %q: got %s %d, want %s %d", tc.data, hash, size, tc.want, tc.size)
+		}
+		rc, err := s.Cat("/ipfs/" + hash)
+		checkFatal(t, err)
+		data, err := ioutil.ReadAll(rc)
+		checkFatal(t, err)
+		if !bytes.Equal(data, tc.data) {
+			t.Errorf("cat %s: got %d bytes, want %d", hash, len(data), len(tc.data))
+		}
+		stored, err := s.Size(hash)
+		checkFatal(t, err)
+		if stored != size {
+			t.Errorf("size of %s: %d != %d", hash, stored, size)
+		}
+	}
+
+	rc, err := s.CatRange(mustAdd(t, s, "0123456789"), 3, 4)
+	checkFatal(t, err)
+	if data, _ := ioutil.ReadAll(rc); string(data) != "3456" {
+		t.Errorf("wrong range %q", data)
+	}
+	// ranges across the chunks of a file
+	bigHash, _, err := s.Add(bytes.NewReader(big), false)
+	checkFatal(t, err)
+	for _, r := range [][2]int64{{addChunkSize - 10, 20}, {addChunkSize + 5, 2 * addChunkSize}, {3 * addChunkSize, -1}, {int64(len(big)) + 1, 10}} {
+		rc, err := s.CatRange("/ipfs/"+bigHash, r[0], r[1])
+		checkFatal(t, err)
+		data, err := ioutil.ReadAll(rc)
+		checkFatal(t, err)
+		want := big[:0]
+		if r[0] < int64(len(big)) {
+			want = big[r[0]:]
+		}
+		if r[1] >= 0 && r[1] < int64(len(want)) {
+			want = want[:r[1]]
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("range %v: got %d bytes, want %d", r, len(data), len(want))
+		}
+	}
+}
+
+func mustAdd(t *testing.T, b Backend, data string) string {
+	hash, _, err := b.Add(strings.NewReader(data), false)
+	checkFatal(t, err)
+	return hash
+}
+
+func TestBlockStore_dirs(t *testing.T) {
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+	for _, s := range []*blockStore{newBlockStore(""), newBlockStore(tmpDir)} {
+		file := mustAdd(t, s, "ref: refs/heads/master\n")
+		fileSize, err := s.Size(file)
+		checkFatal(t, err)
+		repo, repoSize, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData, Links: []shell.ObjectLink{
+			{Name: "HEAD", Hash: file, Size: fileSize},
+			{Name: "refs", Hash: emptyDirCid, Size: 4},
+		}})
+		checkFatal(t, err)
+		root, _, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData, Links: []shell.ObjectLink{
+			{Name: "repo.git", Hash: repo, Size: repoSize},
+		}})
+		checkFatal(t, err)
+
+		links, err := s.List("/ipfs/" + root + "/repo.git")
+		checkFatal(t, err)
+		if len(links) != 2 || links[0].Name != "HEAD" || links[0].Type != unixfsFileType || links[1].Type != unixfsDirType {
+			t.Errorf("wrong links of %s: %+v", repo, links)
+		}
+		if got, err := s.ResolvePath("/ipfs/" + root + "/repo.git/HEAD"); err != nil || got != file {
+			t.Errorf("resolved to %s (%v), want %s", got, err, file)
+		}
+		if _, err := s.ResolvePath("/ipfs/" + root + "/other.git"); !ipfsIsNotExist(err) {
+			t.Errorf("expected a not exist error, got %v", err)
+		}
+
+		checkFatal(t, s.Publish("/ipfs/"+root, "repo"))
+		keys, err := s.Keys()
+		checkFatal(t, err)
+		if len(keys) != 2 || keys[0].Name != "self" || keys[1].Name != "repo" {
+			t.Fatalf("wrong keys %+v", keys)
+		}
+		rc, err := s.Cat("/ipns/" + keys[1].Id + "/repo.git/HEAD")
+		checkFatal(t, err)
+		if data, _ := ioutil.ReadAll(rc); string(data) != "ref: refs/heads/master\n" {
+			t.Errorf("wrong HEAD %q", data)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+// A car (v1) is a header followed by sections, each of them prefixed with its length as uvarint.
+// The header is dag-cbor {"roots": [cid, ...], "version": 1}, a section is a binary cid and its block.
+// Cars move repos to places without a network: export-car writes one, ipfs+car:// urls read from them.
+
+// readCAR reads the car r and returns the roots of its header.
+// fn gets every block with its offset in r.
+func readCAR(r io.Reader, fn func(c cid.Cid, offset int64, block []byte) error) ([]cid.Cid, error) {
+	cr, err := newCARReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c, offset, block, err := cr.next()
+		if err == io.EOF {
+			return cr.roots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(c, offset, block); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// carReader reads the blocks of a car one after the other
+type carReader struct {
+	cr    *countingReader
+	roots []cid.Cid
+}
+
+// newCARReader reads the header of the car r
+func newCARReader(r io.Reader) (*carReader, error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	headerLen, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading header failed")
+	}
+	if headerLen > maxBlockSize {
+		return nil, errors.Errorf("header of %d bytes", headerLen)
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(cr, header); err != nil {
+		return nil, errors.Wrap(err, "reading header failed")
+	}
+	roots, version, err := decodeCARHeader(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "illegal header")
+	}
+	if version != 1 {
+		return nil, errors.Errorf("car version %d isn't supported", version)
+	}
+	return &carReader{cr: cr, roots: roots}, nil
+}
+
+// next returns the next block with its cid and offset, io.EOF after the last one
+func (r *carReader) next() (cid.Cid, int64, []byte, error) {
+	sectionLen, err := binary.ReadUvarint(r.cr)
+	if err == io.EOF {
+		return cid.Cid{}, 0, nil, io.EOF
+	}
+	if err != nil {
+		return cid.Cid{}, 0, nil, errors.Wrap(err, "reading section failed")
+	}
+	if sectionLen > maxBlockSize+64 {
+		return cid.Cid{}, 0, nil, errors.Errorf("section of %d bytes", sectionLen)
+	}
+	start := r.cr.n
+	section := make([]byte, sectionLen)
+	if _, err := io.ReadFull(r.cr, section); err != nil {
+		return cid.Cid{}, 0, nil, errors.Wrap(err, "reading section failed")
+	}
+	n, err := cidLen(section)
+	if err != nil {
+		return cid.Cid{}, 0, nil, err
+	}
+	c, err := cid.Cast(section[:n])
+	if err != nil {
+		return cid.Cid{}, 0, nil, errors.Wrap(err, "illegal cid in section")
+	}
+	return c, start + int64(n), section[n:], nil
+}
+
+// countingReader counts the bytes read, for the offsets of the blocks
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+// cidLen returns the length of the binary cid at the start of b
+func cidLen(b []byte) (int, error) {
+	// cidv0 is a bare sha256 multihash
+	if len(b) >= 34 && b[0] == 0x12 && b[1] == 0x20 {
+		return 34, nil
+	}
+	n := 0
+	// version, codec, hash function and digest length
+	var digestLen uint64
+	for i := 0; i < 4; i++ {
+		v, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return 0, errors.New("illegal cid in section")
+		}
+		n += m
+		digestLen = v
+	}
+	if digestLen > uint64(len(b)-n) {
+		return 0, errors.New("illegal cid in section")
+	}
+	return n + int(digestLen), nil
+}
+
+// exportCAR writes the dag p points to as car with it as root to w and returns the root and the number of blocks.
+// The blocks come in the order 'ipfs dag export' writes them, depth first.
+func exportCAR(w io.Writer, p string) (string, int, error) {
+	root, err := backend.ResolvePath(p)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "resolving %s failed", p)
+	}
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "illegal cid %s", root)
+	}
+	bw := bufio.NewWriter(w)
+	header := encodeCARHeader(rootCid)
+	if _, err := bw.Write(append(appendUvarint(nil, uint64(len(header))), header...)); err != nil {
+		return "", 0, err
+	}
+	seen := make(map[string]bool)
+	var walk func(c cid.Cid) error
+	walk = func(c cid.Cid) error {
+		if seen[c.String()] {
+			return nil
+		}
+		seen[c.String()] = true
+		block, err := backend.Block(c.String())
+		if err != nil {
+			return errors.Wrapf(err, "getting block %s failed", c)
+		}
+		if err := verifyBlock(c, block); err != nil {
+			return err
+		}
+		section := append(appendUvarint(nil, uint64(len(c.Bytes())+len(block))), c.Bytes()...)
+		if _, err := bw.Write(append(section, block...)); err != nil {
+			return err
+		}
+		switch c.Type() {
+		case cid.Raw:
+			return nil
+		case cid.DagProtobuf:
+		default:
+			return errors.Errorf("can't export %s, only dag-pb and raw blocks are supported", c)
+		}
+		node, err := decodeDagPB(block)
+		if err != nil {
+			return errors.Wrapf(err, "block %s", c)
+		}
+		for _, l := range node.Links {
+			lc, err := cid.Decode(l.Hash)
+			if err != nil {
+				return errors.Wrapf(err, "illegal link in %s", c)
+			}
+			if err := walk(lc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(rootCid); err != nil {
+		return "", 0, err
+	}
+	return root, len(seen), bw.Flush()
+}
+
+// exportCARFile writes the dag p points to as car to file, which only shows up once it is complete
+func exportCARFile(p, file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "tmp_")
+	if err != nil {
+		return errors.Wrap(err, "tempFile() failed")
+	}
+	root, blocks, err := exportCAR(tmp, p)
+	if err == nil {
+		// it is made to be shipped, unlike the temp files of the repo
+		err = tmp.Chmod(0644)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "close failed")
+	}
+	log.Log("root", root, "blocks", blocks, "file", file, "msg", "exported")
+	return os.Rename(tmp.Name(), file)
+}
+
+// carStore reads the blocks of a car file, checking each of them against its cid.
+// The file is indexed once, blocks are read from it every time they are needed instead of being kept in memory.
+type carStore struct {
+	readOnlyStore
+	root string // the first root of the car
+
+	f     *os.File
+	index map[string]carBlock
+}
+
+// carBlock is where a block is in the car file
+type carBlock struct {
+	offset int64
+	size   int
+}
+
+func newCARStore(file string) (*carStore, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening car failed")
+	}
+	s := &carStore{readOnlyStore: readOnlyStore{newBlockStore("")}, f: f, index: make(map[string]carBlock)}
+	roots, err := readCAR(f, func(c cid.Cid, offset int64, block []byte) error {
+		s.index[c.String()] = carBlock{offset: offset, size: len(block)}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "reading car %s failed", file)
+	}
+	if len(roots) == 0 {
+		f.Close()
+		return nil, errors.Errorf("car %s has no root", file)
+	}
+	s.root = roots[0].String()
+	s.blockStore.fetch = s.fetch
+	log.Log("file", file, "root", s.root, "blocks", len(s.index), "event", "debug", "msg", "indexed car")
+	return s, nil
+}
+
+func (s *carStore) fetch(c string) ([]byte, error) {
+	parsed, err := cid.Decode(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "illegal cid %s", c)
+	}
+	b, ok := s.index[parsed.String()]
+	if !ok {
+		return nil, errors.Errorf("block %s is not in %s", c, s.f.Name())
+	}
+	block := make([]byte, b.size)
+	if _, err := s.f.ReadAt(block, b.offset); err != nil {
+		return nil, errors.Wrapf(err, "reading block %s failed", c)
+	}
+	if err := verifyBlock(parsed, block); err != nil {
+		return nil, errors.Wrapf(err, "car %s", s.f.Name())
+	}
+	return block, nil
+}
+
+// parseCARURL splits ipfs+car:///path/to/repo.car/repo.git into the car file and the path of the repo in it
+func parseCARURL(u string) (string, string, error) {
+	p := strings.TrimPrefix(u, "ipfs+car://")
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if strings.HasSuffix(part, ".car") {
+			return strings.Join(parts[:i+1], "/"), strings.Join(parts[i+1:], "/"), nil
+		}
+	}
+	return "", "", errors.Errorf("no .car file in %q", u)
+}
+
+// encodeCARHeader returns the dag-cbor header of a car with one root
+func encodeCARHeader(root cid.Cid) []byte {
+	b := appendCBORHead(nil, 5, 2) // map of two
+	b = appendCBORHead(b, 3, 5)
+	b = append(b, "roots"...)
+	b = appendCBORHead(b, 4, 1)
+	b = appendCBORHead(b, 6, 42) // cid tag
+	link := append([]byte{0}, root.Bytes()...)
+	b = appendCBORHead(b, 2, uint64(len(link)))
+	b = append(b, link...)
+	b = appendCBORHead(b, 3, 7)
+	b = append(b, "version"...)
+	return appendCBORHead(b, 0, 1)
+}
+
+// decodeCARHeader returns the roots and version of a car header
+func decodeCARHeader(b []byte) ([]cid.Cid, uint64, error) {
+	major, pairs, b, err := cborHead(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if major != 5 {
+		return nil, 0, errors.New("header is not a map")
+	}
+	var (
+		roots   []cid.Cid
+		version uint64
+	)
+	for i := uint64(0); i < pairs; i++ {
+		major, n, rest, err := cborHead(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		if major != 3 || n > uint64(len(rest)) {
+			return nil, 0, errors.New("illegal key")
+		}
+		key := string(rest[:n])
+		b = rest[n:]
+		switch key {
+		case "version":
+			if major, version, b, err = cborHead(b); err != nil || major != 0 {
+				return nil, 0, errors.New("illegal version")
+			}
+		case "roots":
+			major, n, b, err = cborHead(b)
+			if err != nil || major != 4 {
+				return nil, 0, errors.New("illegal roots")
+			}
+			for j := uint64(0); j < n; j++ {
+				var tag, size uint64
+				if major, tag, b, err = cborHead(b); err != nil || major != 6 || tag != 42 {
+					return nil, 0, errors.New("root is not a cid")
+				}
+				if major, size, b, err = cborHead(b); err != nil || major != 2 || size > uint64(len(b)) || size < 1 || b[0] != 0 {
+					return nil, 0, errors.New("root is not a cid")
+				}
+				c, err := cid.Cast(b[1:size])
+				if err != nil {
+					return nil, 0, errors.Wrap(err, "illegal root")
+				}
+				roots = append(roots, c)
+				b = b[size:]
+			}
+		default:
+			if b, err = cborSkip(b); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return roots, version, nil
+}
+
+// cborHead returns the major type and the argument of the cbor item at the start of b and what follows them
+func cborHead(b []byte) (byte, uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	if info < 24 {
+		return major, uint64(info), b, nil
+	}
+	if info > 27 {
+		return 0, 0, nil, errors.New("indefinite lengths aren't dag-cbor")
+	}
+	n := 1 << (info - 24)
+	if len(b) < n {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	var arg uint64
+	for _, c := range b[:n] {
+		arg = arg<<8 | uint64(c)
+	}
+	return major, arg, b[n:], nil
+}
+
+// cborSkip returns what follows the cbor item at the start of b
+func cborSkip(b []byte) ([]byte, error) {
+	major, arg, b, err := cborHead(b)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 2, 3: // bytes and text
+		if arg > uint64(len(b)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b[arg:], nil
+	case 4, 5: // arrays and maps
+		items := arg
+		if major == 5 {
+			items *= 2
+		}
+		for i := uint64(0); i < items; i++ {
+			if b, err = cborSkip(b); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case 6: // the tagged item
+		return cborSkip(b)
+	}
+	return b, nil
+}
+
+func appendCBORHead(b []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(b, major<<5|byte(arg))
+	case arg < 1<<8:
+		return append(b, major<<5|24, byte(arg))
+	case arg < 1<<16:
+		return append(b, major<<5|25, byte(arg>>8), byte(arg))
+	case arg < 1<<32:
+		return append(b, major<<5|26, byte(arg>>24), byte(arg>>16), byte(arg>>8), byte(arg))
+	}
+	b = append(b, major<<5|27)
+	for i := 56; i >= 0; i -= 8 {
+		b = append(b, byte(arg>>uint(i)))
+	}
+	return b
+}
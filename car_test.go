@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cryptix/go/logging"
+	"github.com/cryptix/go/logging/logtest"
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+func TestCAR(t *testing.T) {
+	defer func(l logging.Interface, b Backend) { log, backend = l, b }(log, backend)
+	log, _ = logtest.KitLogger("TestCAR", t)
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+
+	s := newBlockStore("")
+	backend = s
+	head := mustAdd(t, s, "ref: refs/heads/master\n")
+	big := make([]byte, 2*addChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(big)
+	pack := mustAdd(t, s, string(big))
+	rawData := []byte("raw leaf\n")
+	raw, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(rawData)
+	checkFatal(t, err)
+	checkFatal(t, s.write("blocks", raw.String(), rawData))
+	headSize, err := s.Size(head)
+	checkFatal(t, err)
+	packSize, err := s.Size(pack)
+	checkFatal(t, err)
+	repo, repoSize, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData, Links: []shell.ObjectLink{
+		{Name: "HEAD", Hash: head, Size: headSize},
+		{Name: "pack", Hash: pack, Size: packSize},
+		// the same block twice is only exported once
+		{Name: "pack2", Hash: pack, Size: packSize},
+		{Name: "raw", Hash: raw.String(), Size: uint64(len(rawData))},
+	}})
+	checkFatal(t, err)
+	root, _, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData, Links: []shell.ObjectLink{
+		{Name: "repo.git", Hash: repo, Size: repoSize},
+	}})
+	checkFatal(t, err)
+
+	file := filepath.Join(tmpDir, "repo.car")
+	checkFatal(t, exportCARFile("/ipfs/"+root, file))
+	car, err := newCARStore(file)
+	checkFatal(t, err)
+	if car.root != root {
+		t.Errorf("root of the car is %s, want %s", car.root, root)
+	}
+	// root, repo, HEAD, the pack and its 3 chunks and the raw leaf
+	if len(car.index) != 8 {
+		t.Errorf("%d blocks in the car, want 8", len(car.index))
+	}
+	for name, want := range map[string][]byte{"HEAD": []byte("ref: refs/heads/master\n"), "pack2": big, "raw": rawData} {
+		rc, err := car.Cat("/ipfs/" + car.root + "/repo.git/" + name)
+		checkFatal(t, err)
+		data, err := ioutil.ReadAll(rc)
+		checkFatal(t, err)
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: got %d bytes, want %d", name, len(data), len(want))
+		}
+	}
+	if len(car.mem) != 0 {
+		t.Errorf("%d blocks of the car are kept in memory", len(car.mem))
+	}
+	if _, err := car.ResolvePath("/ipfs/" + car.root + "/other.git"); !ipfsIsNotExist(err) {
+		t.Errorf("expected a not exist error, got %v", err)
+	}
+	if _, _, err := car.Add(bytes.NewReader(nil), false); err != errReadOnly {
+		t.Errorf("expected a read-only car, got %v", err)
+	}
+
+	// the raw leaf is the last block
+	data, err := ioutil.ReadFile(file)
+	checkFatal(t, err)
+	data[len(data)-1] ^= 1
+	checkFatal(t, ioutil.WriteFile(file, data, 0600))
+	car, err = newCARStore(file)
+	checkFatal(t, err)
+	if _, err := car.Cat("/ipfs/" + car.root + "/repo.git/raw"); errors.Cause(err) != errBadBlock {
+		t.Errorf("expected a bad block, got %v", err)
+	}
+	checkFatal(t, os.Remove(file))
+}
+
+func TestCARHeader(t *testing.T) {
+	root, err := cid.Decode(emptyDirCid)
+	checkFatal(t, err)
+	roots, version, err := decodeCARHeader(encodeCARHeader(root))
+	checkFatal(t, err)
+	if version != 1 || len(roots) != 1 || !roots[0].Equals(root) {
+		t.Errorf("got version %d and roots %v", version, roots)
+	}
+	// unknown keys are skipped
+	header := appendCBORHead(nil, 5, 2)
+	header = append(appendCBORHead(header, 3, 4), "note"...)
+	header = appendCBORHead(header, 4, 2)
+	header = append(appendCBORHead(header, 2, 300), make([]byte, 300)...)
+	header = appendCBORHead(header, 0, 1<<40)
+	header = append(appendCBORHead(header, 3, 7), "version"...)
+	header = appendCBORHead(header, 0, 2)
+	if roots, version, err = decodeCARHeader(header); err != nil || version != 2 || len(roots) != 0 {
+		t.Errorf("got version %d, roots %v and %v", version, roots, err)
+	}
+	if _, _, err := decodeCARHeader(header[:len(header)-3]); err == nil {
+		t.Error("expected an error for a short header")
+	}
+}
+
+func TestParseCARURL(t *testing.T) {
+	for _, tc := range []struct {
+		url, file, sub string
+	}{
+		{"ipfs+car:///media/usb/repo.car/repo.git", "/media/usb/repo.car", "repo.git"},
+		{"ipfs+car:///repo.car", "/repo.car", ""},
+		{"ipfs+car://repos/all.car/a/b.git", "repos/all.car", "a/b.git"},
+		{"ipfs+car:///media/usb/repo.git", "", ""},
+	} {
+		file, sub, err := parseCARURL(tc.url)
+		if tc.file == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.url)
+			}
+			continue
+		}
+		checkFatal(t, err)
+		if file != tc.file || sub != tc.sub {
+			t.Errorf("%s: got %s %s, want %s %s", tc.url, file, sub, tc.file, tc.sub)
+		}
+	}
+}
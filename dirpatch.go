@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/binary"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+// unixfsDirData is the data field of a plain unixfs directory node: the protobuf encoding of Type=Directory.
+// Sharded directories (HAMT) have a different type and can't be edited link by link.
+const unixfsDirData = "\x08\x01"
+
+// rootPatch collects links to add to and remove from the repo tree and applies them in one pass.
+// Every touched directory is read and written once, bottom up, instead of calling object/patch per link,
+// which costs a request and leaves an intermediate root behind for every single object.
+type rootPatch struct {
+	root string
+	top  *dirPatch
+}
+
+type dirPatch struct {
+	node  *shell.IpfsObject // the existing directory, loaded on first use
+	fresh bool              // replaces whatever was there before, starts empty
+	keep  bool              // written even without links
+	set   map[string]shell.ObjectLink
+	rm    map[string]bool
+	dirs  map[string]*dirPatch
+}
+
+func newDirPatch() *dirPatch {
+	return &dirPatch{
+		set:  make(map[string]shell.ObjectLink),
+		rm:   make(map[string]bool),
+		dirs: make(map[string]*dirPatch),
+	}
+}
+
+func newRootPatch(root string) *rootPatch {
+	return &rootPatch{root: root, top: newDirPatch()}
+}
+
+// dir returns the pending changes of the directory at p, creating intermediate entries as needed
+func (rp *rootPatch) dir(p string) *dirPatch {
+	d := rp.top
+	for _, name := range splitPath(p) {
+		child, ok := d.dirs[name]
+		if !ok {
+			child = newDirPatch()
+			child.fresh = d.rm[name]
+			if _, replaced := d.set[name]; replaced {
+				child.fresh = true
+			}
+			delete(d.set, name)
+			delete(d.rm, name)
+			d.dirs[name] = child
+		}
+		d = child
+	}
+	return d
+}
+
+// addLink links hash with its cumulative size at p, replacing an existing link of that name
+func (rp *rootPatch) addLink(p, hash string, size uint64) {
+	dir, name := path.Split(p)
+	d := rp.dir(dir)
+	delete(d.rm, name)
+	delete(d.dirs, name)
+	d.set[name] = shell.ObjectLink{Name: name, Hash: hash, Size: size}
+}
+
+// mkdir makes sure the directory at p exists, even if nothing is linked into it
+func (rp *rootPatch) mkdir(p string) {
+	rp.dir(p).keep = true
+}
+
+// rmLink removes the link at p. Removing a link that doesn't exist is not an error.
+func (rp *rootPatch) rmLink(p string) {
+	dir, name := path.Split(p)
+	d := rp.dir(dir)
+	delete(d.set, name)
+	delete(d.dirs, name)
+	d.rm[name] = true
+}
+
+// names returns the sorted names in the directory at p with all pending changes applied.
+// A directory that doesn't exist has no names.
+func (rp *rootPatch) names(p string) ([]string, error) {
+	d := rp.top
+	if err := d.load(rp.root); err != nil {
+		return nil, err
+	}
+	for _, name := range splitPath(p) {
+		child, ok := d.dirs[name]
+		if !ok {
+			if _, replaced := d.set[name]; replaced || d.rm[name] {
+				return nil, nil
+			}
+			// remember the unchanged directory to load it only once
+			child = newDirPatch()
+			d.dirs[name] = child
+		}
+		if err := child.load(d.childHash(name)); err != nil {
+			return nil, errors.Wrapf(err, "loading %s failed", p)
+		}
+		d = child
+	}
+	var names []string
+	for _, l := range d.merged() {
+		names = append(names, l.Name)
+	}
+	for name, child := range d.dirs {
+		if child.changed() || d.linkHash(name) != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// apply writes all changed directories and returns the new root.
+// Without any pending changes the old root is returned as is.
+func (rp *rootPatch) apply() (string, error) {
+	root, _, err := rp.applyWith(backend.PutDir)
+	return root, err
+}
+
+// dryApply returns the root apply would create and its cumulative size without writing anything
+func (rp *rootPatch) dryApply() (string, uint64, error) {
+	if !rp.top.changed() {
+		size, err := backend.Size(rp.root)
+		return rp.root, size, err
+	}
+	return rp.applyWith(hashDir)
+}
+
+// dirPutter stores a directory node and returns its hash and cumulative size
+type dirPutter func(*shell.IpfsObject) (string, uint64, error)
+
+// applyWith writes the changed directories with put. The size is only known if anything changed.
+func (rp *rootPatch) applyWith(put dirPutter) (string, uint64, error) {
+	if !rp.top.changed() {
+		return rp.root, 0, nil
+	}
+	root, size, err := rp.top.apply(rp.root, put)
+	if err != nil {
+		return "", 0, err
+	}
+	rp.root, rp.top = root, newDirPatch()
+	return root, size, nil
+}
+
+func (d *dirPatch) changed() bool {
+	if d.fresh || d.keep || len(d.set) > 0 || len(d.rm) > 0 {
+		return true
+	}
+	for _, child := range d.dirs {
+		if child.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the existing directory hash, an empty hash stands for a new directory
+func (d *dirPatch) load(hash string) error {
+	if d.node != nil {
+		return nil
+	}
+	if hash == "" || d.fresh {
+		d.node = &shell.IpfsObject{Data: unixfsDirData}
+		return nil
+	}
+	node, err := backend.GetDir(hash)
+	if err != nil {
+		return errors.Wrapf(err, "getDir(%s) failed", hash)
+	}
+	if node.Data != unixfsDirData {
+		return errors.Errorf("%s is not a plain unixfs directory", hash)
+	}
+	d.node = node
+	return nil
+}
+
+func (d *dirPatch) linkHash(name string) string {
+	for _, l := range d.node.Links {
+		if l.Name == name {
+			return l.Hash
+		}
+	}
+	return ""
+}
+
+// childHash returns the existing hash of the subdirectory name, "" if it's new or replaced
+func (d *dirPatch) childHash(name string) string {
+	if child := d.dirs[name]; child == nil || child.fresh {
+		return ""
+	}
+	return d.linkHash(name)
+}
+
+// merged returns the links of the loaded directory with the pending links set and removed,
+// subdirectories with pending changes are not included
+func (d *dirPatch) merged() []shell.ObjectLink {
+	var links []shell.ObjectLink
+	for _, l := range d.node.Links {
+		if _, replaced := d.set[l.Name]; replaced || d.rm[l.Name] || d.dirs[l.Name] != nil {
+			continue
+		}
+		links = append(links, l)
+	}
+	for _, l := range d.set {
+		links = append(links, l)
+	}
+	return links
+}
+
+// apply writes the directory that was at hash with all pending changes and returns its new hash and cumulative size
+func (d *dirPatch) apply(hash string, put dirPutter) (string, uint64, error) {
+	if err := d.load(hash); err != nil {
+		return "", 0, err
+	}
+	links := d.merged()
+	for name, child := range d.dirs {
+		childHash := d.childHash(name)
+		if !child.changed() {
+			if childHash != "" {
+				// only loaded for names(), keep the existing link
+				for _, l := range d.node.Links {
+					if l.Name == name {
+						links = append(links, l)
+					}
+				}
+			}
+			continue
+		}
+		newHash, size, err := child.apply(childHash, put)
+		if err != nil {
+			return "", 0, err
+		}
+		links = append(links, shell.ObjectLink{Name: name, Hash: newHash, Size: size})
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Name < links[j].Name })
+	return put(&shell.IpfsObject{Data: unixfsDirData, Links: links})
+}
+
+// hashDir computes the CIDv0 object put would return for node
+func hashDir(node *shell.IpfsObject) (string, uint64, error) {
+	block, err := encodeDagPB(node)
+	if err != nil {
+		return "", 0, err
+	}
+	hash, err := blockCid(block)
+	if err != nil {
+		return "", 0, err
+	}
+	return hash, cumulativeSize(block, node), nil
+}
+
+// blockCid returns the CIDv0 of a dag-pb block
+func blockCid(block []byte) (string, error) {
+	mh, err := multihash.Sum(block, multihash.SHA2_256, -1)
+	if err != nil {
+		return "", errors.Wrap(err, "hashing node failed")
+	}
+	return cid.NewCidV0(mh).String(), nil
+}
+
+// cumulativeSize is the size of block with everything it links to
+func cumulativeSize(block []byte, node *shell.IpfsObject) uint64 {
+	size := uint64(len(block))
+	for _, l := range node.Links {
+		size += l.Size
+	}
+	return size
+}
+
+// encodeDagPB encodes node as dag-pb protobuf: the links, each with hash (1), name (2) and cumulative size (3),
+// as field 2 before the data as field 1, the order the daemon writes them in.
+func encodeDagPB(node *shell.IpfsObject) ([]byte, error) {
+	var block []byte
+	for _, l := range node.Links {
+		c, err := cid.Decode(l.Hash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "illegal link hash %q", l.Hash)
+		}
+		var link []byte
+		link = appendPBBytes(link, 1, c.Bytes())
+		link = appendPBBytes(link, 2, []byte(l.Name))
+		link = appendPBVarint(link, 3, l.Size)
+		block = appendPBBytes(block, 2, link)
+	}
+	return appendPBBytes(block, 1, []byte(node.Data)), nil
+}
+
+// decodeDagPB is the reverse of encodeDagPB
+func decodeDagPB(block []byte) (*shell.IpfsObject, error) {
+	node := &shell.IpfsObject{}
+	err := readPBFields(block, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			node.Data = string(data)
+		case 2:
+			var l shell.ObjectLink
+			err := readPBFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case 1:
+					c, err := cid.Cast(data)
+					if err != nil {
+						return errors.Wrap(err, "illegal link hash")
+					}
+					l.Hash = c.String()
+				case 2:
+					l.Name = string(data)
+				case 3:
+					l.Size = v
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			node.Links = append(node.Links, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding dag-pb node failed")
+	}
+	return node, nil
+}
+
+// readPBFields calls fn with the number and the value of every varint (wire type 0) or length delimited (wire type 2) field of msg
+func readPBFields(msg []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("illegal field key")
+		}
+		msg = msg[n:]
+		v, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("illegal varint")
+		}
+		msg = msg[n:]
+		var data []byte
+		switch key & 7 {
+		case 0:
+		case 2:
+			if v > uint64(len(msg)) {
+				return errors.New("field exceeds message")
+			}
+			data, msg = msg[:v], msg[v:]
+		default:
+			return errors.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendPBVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3) // wire type 0
+	return appendUvarint(b, v)
+}
+
+func appendPBBytes(b []byte, field int, data []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2) // wire type 2, length delimited
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func splitPath(p string) []string {
+	var parts []string
+	for _, s := range strings.Split(p, "/") {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return parts
+}
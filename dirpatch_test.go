@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+func TestHashDir(t *testing.T) {
+	cases := []struct {
+		links []shell.ObjectLink
+		want  string
+		size  uint64
+	}{
+		// the well known empty directory
+		{nil, "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn", 4},
+		// checked against go-merkledag, with a CIDv1 link
+		{[]shell.ObjectLink{
+			{Name: "HEAD", Hash: "QmdpMF6NVRCGR4Cco5XDKLvpmEQ2tTBfFfe3GsEADojBii", Size: 23},
+			{Name: "info", Hash: "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn", Size: 4},
+			{Name: "objects", Hash: "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", Size: 300000},
+		}, "QmW8XnJMJrmHqGBp1APzdAy9L9BKm8UfPLZgRpDZBJN7vj", 0},
+	}
+	for _, tc := range cases {
+		hash, size, err := hashDir(&shell.IpfsObject{Data: unixfsDirData, Links: tc.links})
+		checkFatal(t, err)
+		if hash != tc.want {
+			t.Errorf("wrong hash for %d links: %s != %s", len(tc.links), hash, tc.want)
+		}
+		if tc.size != 0 && size != tc.size {
+			t.Errorf("wrong size for %d links: %d != %d", len(tc.links), size, tc.size)
+		}
+	}
+
+	if _, _, err := hashDir(&shell.IpfsObject{Data: unixfsDirData, Links: []shell.ObjectLink{{Name: "x", Hash: "not a cid"}}}); err == nil {
+		t.Error("expected error for broken link hash")
+	}
+}
@@ -6,81 +6,282 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
-	"github.com/cryptix/exp/git"
 	"github.com/pkg/errors"
 )
 
+// fetchBatch fetches all objects reachable from wants.
+// connected reports whether this batch downloaded all of them itself, which is when git may skip its connectivity check.
+func fetchBatch(wants []string) (connected bool, err error) {
+	// while cloning we need (nearly) everything anyway,
+	// so downloading whole packs is cheaper than reading them object by object
+	rangePacks := sessionPacks
+	if options.cloning && options.depth == 0 {
+		rangePacks = nil
+	}
+	downloaded := make(map[string]bool)
+	connected, err = fetchClosure(wants, rangePacks, downloaded)
+	if err != nil || !options.followTags {
+		return connected && options.depth == 0, err
+	}
+	tags, err := followedTags()
+	if err != nil {
+		return false, errors.Wrap(err, "finding tags to follow failed")
+	}
+	tagsConnected, err := fetchClosure(tags, rangePacks, downloaded)
+	return connected && tagsConnected && options.depth == 0, err
+}
+
+// fetchClosure fetches wants and everything they link to, up to options.depth commits.
+// downloaded collects the objects downloaded by the batch, connected reports whether every object was one of them.
+func fetchClosure(wants []string, rangePacks *remotePacks, downloaded map[string]bool) (connected bool, err error) {
+	var (
+		tried   = make(map[string]struct{})
+		shallow []string
+	)
+	connected = true
+	for len(wants) > 0 {
+		packed, boundary, complete, err := fetchObjects(wants, rangePacks, downloaded)
+		if err != nil {
+			return false, errors.Wrap(err, "fetchObjects() failed")
+		}
+		// objects of imported packs and the ones they link to are only checked to be there
+		connected = connected && complete && len(packed) == 0 && len(boundary) == 0
+		shallow = append(shallow, boundary...)
+		wants = nil
+		for _, sha1 := range packed {
+			if _, ok := tried[sha1]; ok {
+				return false, errors.Errorf("sha1<%s> still missing after importing its pack", sha1)
+			}
+			tried[sha1] = struct{}{}
+			p, err := fetchPackedObject(sessionPacks, sha1)
+			if err != nil {
+				return false, errors.Wrap(err, "fetchPackedObject() failed")
+			}
+			if p == nil {
+				continue
+			}
+			// objects in the imported pack can link to loose objects of the remote, like pushed packs on top of loose history
+			missing, err := p.missingLinks()
+			if err != nil {
+				return false, errors.Wrapf(err, "finding missing links of %s failed", p.path)
+			}
+			wants = append(wants, missing...)
+		}
+	}
+	if len(shallow) > 0 {
+		return false, gitAddShallow(shallow)
+	}
+	return connected, nil
+}
+
+// followedTags returns the annotated tags of the remote that point to objects we have now, but aren't here themselves.
+// Only works with info/refs, which has the peeled objects of the tags.
+func followedTags() ([]string, error) {
+	var tags []string
+	for ref, sha1 := range ref2hash {
+		if !strings.HasPrefix(ref, "refs/tags/") || strings.HasSuffix(ref, peeledSuffix) {
+			continue
+		}
+		peeled, ok := ref2hash[ref+peeledSuffix]
+		if !ok {
+			continue
+		}
+		hasTag, err := gitHasObject(sha1)
+		if err != nil {
+			return nil, err
+		}
+		if hasTag {
+			continue
+		}
+		hasPeeled, err := gitHasObject(peeled)
+		if err != nil {
+			return nil, err
+		}
+		if hasPeeled {
+			tags = append(tags, sha1)
+		}
+	}
+	return tags, nil
+}
+
 // "fetch $sha1 $ref" method 1 - unpacking loose objects
 //   - look for it in ".git/objects/substr($sha1, 0, 2)/substr($sha, 2)"
 //   - if found, download it and put it in place. (there may be a command for this)
+//   - walk everything it links to: all parents, trees, subtrees and blobs of commits and the target of tags
+//   - objects that are already in the local repo are neither downloaded nor descended into,
+//     so an incremental fetch stops at the first commit we already have
 //   - done \o/
-func fetchObject(sha1 string) error {
-	return recurseCommit(sha1)
-}
-
-func recurseCommit(sha1 string) error {
-	obj, err := fetchAndWriteObj(sha1)
-	if err != nil {
-		return errors.Wrapf(err, "fetchAndWriteObj(%s) commit object failed", sha1)
+//
+// The graph is discovered breadth first and downloaded by fetchJobs() workers.
+// Objects which aren't stored loosely in the remote are read out of rangePacks by byte ranges, see fetchRangeObject.
+// If rangePacks is nil, they are returned instead, so that their whole packs can be fetched.
+// With options.depth the parents of commits that deep aren't fetched, these commits are returned as the shallow boundary.
+// Downloaded objects are added to downloaded. complete reports whether the walk only stopped at objects in it,
+// the local objects from before can't be trusted to have all they link to.
+func fetchObjects(wants []string, rangePacks *remotePacks, downloaded map[string]bool) (packed, shallow []string, complete bool, err error) {
+	type result struct {
+		sha1  string
+		kind  string
+		links []string
+		err   error
 	}
-	commit, ok := obj.Commit()
-	if !ok {
-		return errors.Errorf("sha1<%s> is not a git commit object:%s ", sha1, obj)
+	var (
+		jobs    = make(chan string)
+		results = make(chan result)
+		n       = fetchJobs()
+	)
+	for i := 0; i < n; i++ {
+		go func() {
+			for sha1 := range jobs {
+				has, err := gitHasObject(sha1)
+				if err != nil || has {
+					results <- result{sha1: sha1, err: errors.Wrapf(err, "gitHasObject(%s) failed", sha1)}
+					continue
+				}
+				obj, err := fetchAndWriteObj(sha1)
+				if errors.Cause(err) == errNoLooseObject && rangePacks != nil {
+					obj, err = fetchRangeObject(rangePacks, sha1)
+				}
+				if err != nil {
+					results <- result{sha1: sha1, err: err}
+					continue
+				}
+				links, err := obj.links()
+				if err != nil {
+					err = errors.Wrapf(err, "sha1<%s> broken %s object", sha1, obj.Type)
+				}
+				results <- result{sha1: sha1, kind: obj.Type, links: links, err: err}
+			}
+		}()
 	}
-	if commit.Parent != "" {
-		if err := recurseCommit(commit.Parent); err != nil {
-			return errors.Wrapf(err, "recurseCommit(%s) commit Parent failed", commit.Parent)
+	defer close(jobs)
+
+	var (
+		seen     = make(map[string]int) // sha1 -> depth, in commits from the wants
+		queue    []string
+		inflight int
+		fetched  int
+		stale    int // objects that were already here before this batch
+		firstErr error
+	)
+	enqueue := func(shas []string, depth int) {
+		for _, sha1 := range shas {
+			if _, ok := seen[sha1]; ok {
+				continue
+			}
+			seen[sha1] = depth
+			queue = append(queue, sha1)
+		}
+	}
+	enqueue(wants, 1)
+	// after an error only the jobs in flight are waited for
+	for (len(queue) > 0 && firstErr == nil) || inflight > 0 {
+		var (
+			send chan<- string
+			next string
+		)
+		if len(queue) > 0 && firstErr == nil {
+			send, next = jobs, queue[0]
+		}
+		select {
+		case send <- next:
+			queue = queue[1:]
+			inflight++
+		case res := <-results:
+			inflight--
+			if res.err == nil && res.kind != "" {
+				fetched++
+				downloaded[res.sha1] = true
+				progressf(false, "Fetching objects: %d", fetched)
+			}
+			if res.err == nil && res.kind == "" && !downloaded[res.sha1] {
+				stale++
+			}
+			switch {
+			case res.err == nil && res.kind == "commit":
+				// the tree comes first, then the parents
+				depth := seen[res.sha1]
+				enqueue(res.links[:1], depth)
+				if options.depth > 0 && depth >= options.depth && len(res.links) > 1 {
+					shallow = append(shallow, res.sha1)
+					break
+				}
+				enqueue(res.links[1:], depth+1)
+			case res.err == nil:
+				enqueue(res.links, seen[res.sha1])
+			case errors.Cause(res.err) == errNoLooseObject:
+				log.Log("sha1", res.sha1, "event", "debug", "msg", "not a loose object, trying packs later")
+				packed = append(packed, res.sha1)
+			case firstErr == nil:
+				firstErr = errors.Wrapf(res.err, "fetching sha1<%s> failed", res.sha1)
+			}
 		}
 	}
-	return fetchTree(commit.Tree)
+	progressf(true, "Fetching objects: %d", fetched)
+	if firstErr != nil {
+		return nil, nil, false, firstErr
+	}
+	log.Log("objects", len(seen), "packed", len(packed), "shallow", len(shallow), "present", stale, "jobs", n, "event", "debug", "msg", "walked loose objects")
+	return packed, shallow, stale == 0, nil
 }
 
-func fetchTree(sha1 string) error {
-	obj, err := fetchAndWriteObj(sha1)
+const defaultFetchJobs = 8
+
+// fetchJobs returns the number of parallel downloads, configured with 'git config ipfs.fetchJobs'
+func fetchJobs() int {
+	v, err := gitConfigGet("ipfs.fetchJobs")
 	if err != nil {
-		return errors.Wrapf(err, "fetchAndWriteObj(%s) commit tree failed", sha1)
+		log.Log("err", err, "msg", "reading ipfs.fetchJobs failed - using default")
+		return defaultFetchJobs
 	}
-	entries, ok := obj.Tree()
-	if !ok {
-		return errors.Errorf("sha1<%s> is not a git tree object:%s ", sha1, obj)
+	if v == "" {
+		return defaultFetchJobs
 	}
-	for _, t := range entries {
-		obj, err := fetchAndWriteObj(t.SHA1Sum.String())
-		if err != nil {
-			return errors.Wrapf(err, "fetchAndWriteObj(%s) commit tree failed", sha1)
-		}
-		if obj.Type != git.BlobT {
-			return errors.Errorf("sha1<%s> is not a git tree object:%s ", t.SHA1Sum.String(), obj)
-		}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Log("value", v, "msg", "illegal ipfs.fetchJobs - using default")
+		return defaultFetchJobs
 	}
-	return nil
+	return n
 }
 
+// errNoLooseObject is the cause of fetchAndWriteObj errors for objects the remote doesn't have as loose objects
+var errNoLooseObject = errors.New("no such loose object")
+
 // fetchAndWriteObj looks for the loose object under 'thisGitRepo' global git dir
 // and usses an io.TeeReader to write it to the local repo
-func fetchAndWriteObj(sha1 string) (*git.Object, error) {
+func fetchAndWriteObj(sha1 string) (*gitObject, error) {
+	if !isSha1(sha1) {
+		return nil, errors.Errorf("illegal sha1 %q", sha1)
+	}
 	p := filepath.Join(ipfsRepoPath, "objects", sha1[:2], sha1[2:])
-	ipfsCat, err := ipfsShell.Cat(p)
-	if err != nil {
-		return nil, errors.Wrapf(err, "shell.Cat() commit failed")
+	ipfsCat, err := backend.Cat(p)
+	if ipfsIsNotExist(err) {
+		return nil, errors.Wrapf(errNoLooseObject, "shell.Cat(%s) failed: %s", p, err)
 	}
-	targetP := filepath.Join(thisGitRepo, "objects", sha1[:2], sha1[2:])
-	if err := os.MkdirAll(filepath.Join(thisGitRepo, "objects", sha1[:2]), 0700); err != nil {
-		return nil, errors.Wrapf(err, "mkDirAll() failed")
+	if err != nil {
+		// the remote can't be read, looking into its packs won't help
+		return nil, errors.Wrapf(err, "shell.Cat(%s) failed", p)
 	}
-	targetObj, err := os.Create(targetP)
+	targetObj, targetP, err := tempLooseObject(sha1)
 	if err != nil {
-		return nil, errors.Wrapf(err, "os.Create(%s) commit failed", targetP)
+		ipfsCat.Close()
+		return nil, err
 	}
-	obj, err := git.DecodeObject(io.TeeReader(ipfsCat, targetObj))
+	obj, err := decodeObject(io.TeeReader(ipfsCat, targetObj))
 	if err != nil {
-		return nil, errors.Wrapf(err, "git.DecodeObject(commit) failed")
+		ipfsCat.Close()
+		targetObj.Close()
+		os.Remove(targetObj.Name())
+		return nil, errors.Wrapf(err, "decodeObject(%s) failed", sha1)
 	}
 
 	if err := ipfsCat.Close(); err != nil {
 		err = errors.Wrap(err, "ipfs/cat Close failed")
+		targetObj.Close()
 		if errRm := os.Remove(targetObj.Name()); errRm != nil {
 			err = errors.Wrapf(err, "failed removing targetObj: %s", errRm)
 			return nil, err
@@ -88,71 +289,49 @@ func fetchAndWriteObj(sha1 string) (*git.Object, error) {
 		return nil, errors.Wrapf(err, "closing ipfs cat failed")
 	}
 
-	if err := targetObj.Close(); err != nil {
-		return nil, errors.Wrapf(err, "target file close() failed")
+	if err := placeLooseObject(targetObj, targetP); err != nil {
+		return nil, err
 	}
-
 	return obj, nil
 }
 
-// "fetch $sha1 $ref" method 2 - unpacking packed objects
+// "fetch $sha1 $ref" method 2 - fetching packed objects
 //   - look for it in packfiles by fetching ".git/objects/pack/*.idx"
-//     and looking at each idx with cat <idx> | git show-index  (alternatively can learn to read the format in go)
+//     and looking up the sha1 in each of them, see remotePacks
 //   - if found in an <idx>, download the relevant .pack file,
 //     and feed it into `git index-pack --stdin --fix-thin` which will put it into place.
+//   - each pack is only imported once, the other refs of the same fetch batch are most likely in it, too
 //   - done \o/
-func fetchPackedObject(sha1 string) error {
-	// search for all index files
-	packPath := filepath.Join(ipfsRepoPath, "objects", "pack")
-	links, err := ipfsShell.List(packPath)
+//
+// The pack is returned if it was imported by this call.
+func fetchPackedObject(packs *remotePacks, sha1 string) (*remotePack, error) {
+	p, err := packs.find(sha1)
 	if err != nil {
-		return errors.Wrapf(err, "shell FileList(%q) failed", packPath)
+		return nil, errors.Wrapf(err, "fetchPackedObject: loading remote packs failed")
 	}
-	var indexes []string
-	for _, lnk := range links {
-		if lnk.Type == 2 && strings.HasSuffix(lnk.Name, ".idx") {
-			indexes = append(indexes, filepath.Join(packPath, lnk.Name))
-		}
+	if p == nil {
+		return nil, errors.Errorf("did not find sha1<%s> in any index file", sha1)
 	}
-	if len(indexes) == 0 {
-		return errors.New("fetchPackedObject: no idx files found")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.imported {
+		return nil, nil
 	}
-	for _, idx := range indexes {
-		idxF, err := ipfsShell.Cat(idx)
-		if err != nil {
-			return errors.Wrapf(err, "fetchPackedObject: idx<%s> cat(%s) failed", sha1, idx)
-		}
-		// using external git show-index < idxF for now
-		// TODO: parse index file in go to make this portable
-		var b bytes.Buffer
-		showIdx := exec.Command("git", "show-index")
-		showIdx.Stdin = idxF
-		showIdx.Stdout = &b
-		showIdx.Stderr = &b
-		if err := showIdx.Run(); err != nil {
-			return errors.Wrapf(err, "fetchPackedObject: idx<%s> show-index start failed", sha1)
-		}
-		cmdOut := b.String()
-		if !strings.Contains(cmdOut, sha1) {
-			log.Log("idx", filepath.Base(idx), "event", "debug", "msg", "git show-index: sha1 not in index, next idx file")
-			continue
-		}
-		// we found an index with our hash inside
-		pack := strings.Replace(idx, ".idx", ".pack", 1)
-		packF, err := ipfsShell.Cat(pack)
-		if err != nil {
-			return errors.Wrapf(err, "fetchPackedObject: pack<%s> open() failed", sha1)
-		}
-		b.Reset()
-		unpackIdx := exec.Command("git", "unpack-objects")
-		unpackIdx.Dir = thisGitRepo // GIT_DIR
-		unpackIdx.Stdin = packF
-		unpackIdx.Stdout = &b
-		unpackIdx.Stderr = &b
-		if err := unpackIdx.Run(); err != nil {
-			return errors.Wrapf(err, "fetchPackedObject: pack<%s> 'git unpack-objects' failed\nOutput: %s", sha1, b.String())
-		}
-		return nil
+	packF, err := backend.Cat(p.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetchPackedObject: pack<%s> open() failed", sha1)
+	}
+	defer packF.Close()
+	var b bytes.Buffer
+	indexPack := exec.Command("git", "index-pack", "--stdin", "--fix-thin")
+	indexPack.Dir = thisGitRepo // GIT_DIR
+	indexPack.Stdin = packF
+	indexPack.Stdout = &b
+	indexPack.Stderr = &b
+	if err := indexPack.Run(); err != nil {
+		return nil, errors.Wrapf(err, "fetchPackedObject: pack<%s> 'git index-pack' failed\nOutput: %s", sha1, b.String())
 	}
-	return errors.Errorf("did not find sha1<%s> in %d index files", sha1, len(indexes))
+	p.imported = true
+	log.Log("pack", filepath.Base(p.path), "out", strings.TrimSpace(b.String()), "msg", "imported pack")
+	return p, nil
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -12,10 +13,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cryptix/go/logging"
+	"github.com/cryptix/go/logging/logtest"
 	"github.com/jbenet/go-random"
 )
 
-// Warning: these tests assume some networking capabilities... sorry
+// The clone and push tests run git with the installed helper against repos seeded into a block store,
+// neither a daemon nor the network is needed.
 
 var (
 	gitPath string
@@ -26,6 +30,19 @@ func init() {
 	rand.Seed(time.Now().Unix())
 }
 
+func TestMain(m *testing.M) {
+	// the test repos commit without depending on the git config of whoever runs them
+	for k, v := range map[string]string{
+		"GIT_AUTHOR_NAME":     "test",
+		"GIT_AUTHOR_EMAIL":    "test@example.com",
+		"GIT_COMMITTER_NAME":  "test",
+		"GIT_COMMITTER_EMAIL": "test@example.com",
+	} {
+		os.Setenv(k, v)
+	}
+	os.Exit(m.Run())
+}
+
 // checks for the needed tools
 func checkInstalled(t *testing.T) {
 	var err error
@@ -40,24 +57,115 @@ func checkInstalled(t *testing.T) {
 	checkFatal(t, err)
 }
 
+// the files of the test repo and their sha1s
+var testRepoFiles = map[string]string{
+	"hello.txt": "Hello, World!\n",
+	"testA":     "testA\n",
+	"notes":     "some notes\n",
+}
+
 var expectedClone = map[string]string{
-	"testA":     "9417d011822b875da72221c8d188089cbfcee806",
-	"hello.txt": "e2839ad2e47386d342038958fba941fc78e3780e",
-	"notes":     "32ed91604b272860ec911fc2bf4ae631b7900aa8",
+	"testA":     "9aec625e2471618b835367451c739be57a1b326f",
+	"hello.txt": "60fde9c2310b0d4cad4dab8d126b04387efba289",
+	"notes":     "1569f45c40cb40d0edb177110adc9482f5bc5813",
 }
 
 func TestClone(t *testing.T) {
-	// pinned by pinbot, prepared with 'git-ipfs-rehost https://github.com/cryptix/git-remote-ipfs-testcase'
-	rmDir(t, cloneAndCheckout(t, "ipfs://ipfs/QmRKt5VfMS92x77eFQFUVVmYLdLUv24gxyjS7MsMc62B1K/git-remote-ipfs-testcase", expectedClone))
+	// like the repos of 'git-ipfs-rehost', with a pack
+	url, done := seedTestRepo(t, true)
+	defer done()
+	rmDir(t, cloneAndCheckout(t, url, expectedClone))
 }
 
 func TestClone_unpacked(t *testing.T) {
-	// pinned by pinbot, prepared with 'git-ipfs-rehost --unpack https://github.com/cryptix/git-remote-ipfs-testcase unpackedTest'
-	rmDir(t, cloneAndCheckout(t, "ipfs://ipfs/QmZhuM4TxuhxbamPtWHyHYCUXfkqCkgBmWREKF2kqTLbvz/unpackedTest", expectedClone))
+	// like 'git-ipfs-rehost --unpack', only loose objects
+	url, done := seedTestRepo(t, false)
+	defer done()
+	rmDir(t, cloneAndCheckout(t, url, expectedClone))
+}
+
+// TestFetchBatch_connected checks that git is only told to skip its connectivity check
+// when the batch downloaded every object itself
+func TestFetchBatch_connected(t *testing.T) {
+	defer func(l logging.Interface, b Backend, repo, repoPath string, refs map[string]string, opts helperOptions, packs *remotePacks) {
+		log, backend, thisGitRepo, ipfsRepoPath, ref2hash, options, sessionPacks = l, b, repo, repoPath, refs, opts, packs
+	}(log, backend, thisGitRepo, ipfsRepoPath, ref2hash, options, sessionPacks)
+	log, _ = logtest.KitLogger("TestFetchBatch_connected", t)
+
+	for _, tc := range []struct {
+		name      string
+		packed    bool
+		cloning   bool // imports whole packs
+		depth     int
+		again     bool // fetch into the same repo a second time
+		connected bool
+	}{
+		{name: "loose", connected: true},
+		{name: "loose again", again: true},
+		{name: "shallow", depth: 1},
+		{name: "packed by ranges", packed: true, connected: true},
+		{name: "packed", packed: true, cloning: true},
+	} {
+		url, done := seedTestRepo(t, tc.packed)
+		backend = newBlockStore(os.Getenv("GIT_REMOTE_IPFS_STORE"))
+		ipfsRepoPath = urlPath(url)
+		tmpDir := mkRandTmpDir(t)
+		gitIn(t, tmpDir, "init")
+		thisGitRepo = filepath.Join(tmpDir, ".git")
+		ref2hash = make(map[string]string)
+		checkFatal(t, listInfoRefs(false))
+		options = helperOptions{verbosity: 1, depth: tc.depth, cloning: tc.cloning}
+
+		fetch := func() bool {
+			sessionPacks = new(remotePacks)
+			connected, err := fetchBatch([]string{ref2hash["refs/heads/master"]})
+			checkFatal(t, err)
+			return connected
+		}
+		connected := fetch()
+		if tc.again {
+			connected = fetch()
+		}
+		if connected != tc.connected {
+			t.Errorf("%s: connected %v, want %v", tc.name, connected, tc.connected)
+		}
+		rmDir(t, tmpDir)
+		done()
+	}
 }
 
 // helpers
 
+// useTestStore installs the helper and makes it keep its blocks in a new store until the returned func is called
+func useTestStore(t *testing.T) (done func()) {
+	checkInstalled(t)
+	storeDir := mkRandTmpDir(t)
+	checkFatal(t, os.Setenv("GIT_REMOTE_IPFS_STORE", storeDir))
+	return func() {
+		os.Unsetenv("GIT_REMOTE_IPFS_STORE")
+		rmDir(t, storeDir)
+	}
+}
+
+// seedTestRepo pushes a repo with testRepoFiles, one commit per file and an annotated tag into a new block store
+// and returns its url, see useTestStore.
+func seedTestRepo(t *testing.T, packed bool) (url string, done func()) {
+	done = useTestStore(t)
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+	gitIn(t, tmpDir, "init")
+	for _, name := range []string{"hello.txt", "testA", "notes"} {
+		checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(testRepoFiles[name]), 0644))
+		gitIn(t, tmpDir, "add", name)
+		gitIn(t, tmpDir, "commit", "-m", "test: add "+name)
+	}
+	gitIn(t, tmpDir, "tag", "-a", "-m", "test: tag", "v0.1")
+	gitIn(t, tmpDir, "config", "ipfs.pushPack", fmt.Sprint(packed))
+	gitIn(t, tmpDir, "remote", "add", "origin", "ipfs://ipfs/"+emptyDirCid+"/repo.git")
+	gitIn(t, tmpDir, "push", "origin", "HEAD:refs/heads/master", "v0.1")
+	return gitIn(t, tmpDir, "config", "--get", "remote.origin.url"), done
+}
+
 func cloneAndCheckout(t *testing.T, repo string, expected map[string]string) (tmpDir string) {
 	checkInstalled(t)
 	tmpDir = mkRandTmpDir(t)
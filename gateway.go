@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+)
+
+// gatewayBackend reads repos through an http gateway, for cloning and fetching without a daemon.
+// The gateway isn't trusted: blocks are fetched with ?format=raw or as car with ?format=car
+// and every block is checked against its cid before it is used. Paths are resolved locally from the blocks.
+// It is read-only, pushing and ipns names need a daemon.
+type gatewayBackend struct {
+	readOnlyStore // the verified blocks of the paths resolved so far, the content of files isn't kept
+
+	url    string
+	client *http.Client
+}
+
+const (
+	// maxBlockSize is the largest block accepted from a gateway, ipfs itself doesn't exchange bigger ones
+	maxBlockSize = 4 << 20
+
+	carMIME = "application/vnd.ipld.car"
+	rawMIME = "application/vnd.ipld.raw"
+)
+
+// errBadBlock is the cause of errors for blocks that don't match their cid, where they came from can't be trusted
+var errBadBlock = errors.New("block doesn't match its cid")
+
+func newGatewayBackend(url string) (*gatewayBackend, error) {
+	url = strings.TrimSuffix(url, "/")
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if strings.HasPrefix(url, "https://") {
+		var err error
+		if transport.TLSClientConfig, err = apiTLSConfig(url); err != nil {
+			return nil, err
+		}
+	}
+	g := &gatewayBackend{
+		readOnlyStore: readOnlyStore{newBlockStore("")},
+		url:           url,
+		client:        &http.Client{Transport: &apiAuth{base: transport, url: url}},
+	}
+	g.blockStore.fetch = g.fetchBlock
+	g.blockStore.cacheFetched = true
+	return g, nil
+}
+
+// gatewayAddress returns the gateway to read from, the first one set of
+// 'git config remote.<name>.ipfsGateway', 'git config ipfs.gateway' and $IPFS_GATEWAY, or "" to use the daemon
+func gatewayAddress() (string, error) {
+	for _, key := range []string{"remote." + thisGitRemote + ".ipfsGateway", "ipfs.gateway"} {
+		v, err := gitConfigGet(key)
+		if err != nil {
+			return "", err
+		}
+		if v != "" {
+			return v, nil
+		}
+	}
+	return os.Getenv("IPFS_GATEWAY"), nil
+}
+
+func (g *gatewayBackend) Cat(p string) (io.ReadCloser, error) {
+	return g.CatRange(p, 0, -1)
+}
+
+// CatRange gets the blocks of the range of the file as one car while reading it, instead of one request per block
+func (g *gatewayBackend) CatRange(p string, offset, length int64) (io.ReadCloser, error) {
+	c, err := g.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	to := "*"
+	if length >= 0 {
+		to = fmt.Sprint(offset + length - 1)
+	}
+	blocks := &carStream{g: g, root: c, query: fmt.Sprintf("format=car&dag-scope=entity&entity-bytes=%d:%s", offset, to)}
+	rc, err := catFile(c, offset, length, blocks.block)
+	if err != nil {
+		blocks.close()
+		return nil, err
+	}
+	return &carStreamReader{rc, blocks}, nil
+}
+
+// carStream hands out the blocks of a file in the order the car of the gateway has them, with the byte range
+// for gateways that support it. Blocks that aren't in it are fetched one by one, also when the gateway doesn't send cars.
+type carStream struct {
+	g           *gatewayBackend
+	root, query string
+
+	mu      sync.Mutex
+	car     *carReader
+	done    bool              // no more blocks come from the car
+	pending map[string][]byte // blocks the car sent before they were needed
+
+	// the response is closed apart from mu, which is held while waiting for it
+	bodyMu sync.Mutex
+	body   io.ReadCloser
+	closed bool
+}
+
+// maxPendingBlocks limits the blocks kept from cars that don't come in the order the file is read
+const maxPendingBlocks = 64
+
+func (s *carStream) block(c string) ([]byte, error) {
+	want, err := cid.Decode(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "illegal cid %s", c)
+	}
+	// the single block of small files is often there already, from listing the directory
+	block, ok, err := s.g.read("blocks", c)
+	if err != nil || ok {
+		return block, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if block, ok := s.pending[want.String()]; ok {
+		delete(s.pending, want.String())
+		return block, nil
+	}
+	if !s.done && s.car == nil {
+		s.open()
+	}
+	for !s.done {
+		got, _, block, err := s.car.next()
+		if err != nil && s.isClosed() {
+			return nil, errors.Wrapf(err, "car of %s from %s was closed", s.root, s.g.url)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Log("event", "debug", "err", err, "cid", s.root, "msg", "reading car from gateway failed")
+			}
+			s.done = true
+			break
+		}
+		if err := verifyBlock(got, block); err != nil {
+			return nil, errors.Wrapf(err, "car of %s from %s", s.root, s.g.url)
+		}
+		if got.Equals(want) {
+			return block, nil
+		}
+		if len(s.pending) < maxPendingBlocks {
+			s.pending[got.String()] = block
+		}
+	}
+	return s.g.fetchBlock(c)
+}
+
+// open requests the car, the blocks come one by one if that fails
+func (s *carStream) open() {
+	body, err := s.g.get(s.root, s.query, carMIME)
+	if err != nil {
+		log.Log("event", "debug", "err", err, "msg", "gateway didn't send car")
+		s.done = true
+		return
+	}
+	s.bodyMu.Lock()
+	s.body = body
+	closed := s.closed
+	s.bodyMu.Unlock()
+	if closed {
+		body.Close()
+		s.done = true
+		return
+	}
+	if s.car, err = newCARReader(body); err != nil {
+		log.Log("event", "debug", "err", err, "msg", "gateway sent a broken car")
+		s.done = true
+		return
+	}
+	s.pending = make(map[string][]byte)
+}
+
+// close ends the request, also while a block is being read from it
+func (s *carStream) close() {
+	s.bodyMu.Lock()
+	s.closed = true
+	body := s.body
+	s.bodyMu.Unlock()
+	if body != nil {
+		body.Close()
+	}
+}
+
+func (s *carStream) isClosed() bool {
+	s.bodyMu.Lock()
+	defer s.bodyMu.Unlock()
+	return s.closed
+}
+
+// carStreamReader ends the request of the car together with reading the file
+type carStreamReader struct {
+	io.ReadCloser
+	blocks *carStream
+}
+
+func (r *carStreamReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.blocks.close()
+	return err
+}
+
+// fetchBlock gets the block c from the gateway and checks it
+func (g *gatewayBackend) fetchBlock(c string) ([]byte, error) {
+	parsed, err := cid.Decode(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "illegal cid %s", c)
+	}
+	resp, err := g.get(c, "format=raw", rawMIME)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	block, err := ioutil.ReadAll(io.LimitReader(resp, maxBlockSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading block %s from %s failed", c, g.url)
+	}
+	if len(block) > maxBlockSize {
+		return nil, errors.Errorf("block %s from %s is too big", c, g.url)
+	}
+	if err := verifyBlock(parsed, block); err != nil {
+		return nil, errors.Wrapf(err, "gateway %s", g.url)
+	}
+	log.Log("event", "debug", "cid", c, "size", len(block), "msg", "fetched block")
+	return block, nil
+}
+
+func (g *gatewayBackend) get(c, query, accept string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", g.url+"/ipfs/"+c+"?"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting %s from %s failed", c, g.url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("getting %s from %s failed: %s", c, g.url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// verifyBlock checks that block hashes to c
+func verifyBlock(c cid.Cid, block []byte) error {
+	got, err := c.Prefix().Sum(block)
+	if err != nil {
+		return errors.Wrapf(err, "hashing block %s failed", c)
+	}
+	if !got.Equals(c) {
+		return errors.Wrapf(errBadBlock, "%s hashes to %s", c, got)
+	}
+	return nil
+}
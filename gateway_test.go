@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cryptix/go/logging"
+	"github.com/cryptix/go/logging/logtest"
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+// testGateway serves the blocks of a store like a trustless gateway, tampering with the block in bad
+type testGateway struct {
+	store *blockStore
+	mu    sync.Mutex
+	bad   string
+	gets  []string // format and cid of the requests
+}
+
+func (gw *testGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := strings.TrimPrefix(r.URL.Path, "/ipfs/")
+	format := r.URL.Query().Get("format")
+	gw.mu.Lock()
+	gw.gets = append(gw.gets, format+" "+c)
+	gw.mu.Unlock()
+	var out []byte
+	switch format {
+	case "raw":
+		block, err := gw.block(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		out = block
+	case "car":
+		root, err := cid.Decode(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		header := encodeCARHeader(root)
+		out = append(appendUvarint(nil, uint64(len(header))), header...)
+		var walk func(c string) error
+		walk = func(c string) error {
+			block, err := gw.block(c)
+			if err != nil {
+				return err
+			}
+			parsed, err := cid.Decode(c)
+			if err != nil {
+				return err
+			}
+			out = appendUvarint(out, uint64(len(parsed.Bytes())+len(block)))
+			out = append(append(out, parsed.Bytes()...), block...)
+			if isRawCid(c) {
+				return nil
+			}
+			orig, err := gw.store.Block(c)
+			if err != nil {
+				return err
+			}
+			node, err := decodeDagPB(orig)
+			if err != nil {
+				return err
+			}
+			for _, l := range node.Links {
+				if err := walk(l.Hash); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk(c); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "only trustless requests", http.StatusNotAcceptable)
+		return
+	}
+	w.Write(out)
+}
+
+func (gw *testGateway) block(c string) ([]byte, error) {
+	block, err := gw.store.Block(c)
+	if err != nil {
+		return nil, err
+	}
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if c == gw.bad {
+		block = append(append([]byte(nil), block...), 'x')
+	}
+	return block, nil
+}
+
+func TestGatewayBackend(t *testing.T) {
+	defer func(l logging.Interface) { log = l }(log)
+	log, _ = logtest.KitLogger("TestGatewayBackend", t)
+
+	s := newBlockStore("")
+	head := mustAdd(t, s, "ref: refs/heads/master\n")
+	big := make([]byte, 2*addChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(big)
+	pack := mustAdd(t, s, string(big))
+	// a leaf like 'ipfs add --raw-leaves' makes them
+	rawData := []byte("raw leaf\n")
+	raw, err := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(rawData)
+	checkFatal(t, err)
+	checkFatal(t, s.write("blocks", raw.String(), rawData))
+	var links []shell.ObjectLink
+	for _, l := range []struct{ name, hash string }{{"HEAD", head}, {"pack", pack}, {"raw", raw.String()}} {
+		size := uint64(len(rawData))
+		if l.hash != raw.String() {
+			size, err = s.Size(l.hash)
+			checkFatal(t, err)
+		}
+		links = append(links, shell.ObjectLink{Name: l.name, Hash: l.hash, Size: size})
+	}
+	repo, _, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData, Links: links})
+	checkFatal(t, err)
+
+	gw := &testGateway{store: s}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+	cat := func(g *gatewayBackend, name string, offset, length int64) ([]byte, error) {
+		rc, err := g.CatRange("/ipfs/"+repo+"/"+name, offset, length)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	g, err := newGatewayBackend(srv.URL)
+	checkFatal(t, err)
+	ls, err := g.List("/ipfs/" + repo)
+	checkFatal(t, err)
+	if len(ls) != 3 || ls[2].Name != "raw" || ls[2].Type != unixfsFileType {
+		t.Errorf("wrong links %+v", ls)
+	}
+	data, err := cat(g, "HEAD", 0, -1)
+	checkFatal(t, err)
+	if string(data) != "ref: refs/heads/master\n" {
+		t.Errorf("wrong HEAD %q", data)
+	}
+	if data, err = cat(g, "raw", 0, -1); err != nil || !bytes.Equal(data, rawData) {
+		t.Errorf("wrong raw leaf %q (%v)", data, err)
+	}
+	if data, err = cat(g, "pack", addChunkSize-5, 10); err != nil || !bytes.Equal(data, big[addChunkSize-5:addChunkSize+5]) {
+		t.Errorf("wrong range of pack: %d bytes (%v)", len(data), err)
+	}
+	if data, err = cat(g, "pack", 0, -1); err != nil || !bytes.Equal(data, big) {
+		t.Errorf("wrong pack: %d bytes (%v)", len(data), err)
+	}
+	pb, err := s.GetDir(pack)
+	checkFatal(t, err)
+	for _, get := range gw.gets {
+		for _, l := range pb.Links {
+			if get == "raw "+l.Hash {
+				t.Errorf("the parts of files should come as car, got %s", get)
+			}
+		}
+	}
+
+	if _, _, err := g.Add(strings.NewReader("new"), false); err != errReadOnly {
+		t.Errorf("expected read-only gateway, got %v", err)
+	}
+
+	// a fresh session for each block the gateway lies about
+	for _, bad := range []string{repo, head, pb.Links[1].Hash} {
+		gw.mu.Lock()
+		gw.bad = bad
+		gw.mu.Unlock()
+		g, err := newGatewayBackend(srv.URL)
+		checkFatal(t, err)
+		_, headErr := cat(g, "HEAD", 0, -1)
+		_, packErr := cat(g, "pack", 0, -1)
+		if headErr == nil && packErr == nil {
+			t.Errorf("tampered block %s wasn't noticed", bad)
+		}
+		for _, err := range []error{headErr, packErr} {
+			if err != nil && errors.Cause(err) != errBadBlock {
+				t.Errorf("tampered block %s: unexpected error %v", bad, err)
+			}
+		}
+	}
+}
@@ -7,17 +7,20 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
-// return the objects reachable from ref excluding the objects reachable from exclude
-func gitListObjects(ref string, exclude []string) ([]string, error) {
-	args := []string{"rev-list", "--objects", ref}
+// return the objects reachable from refs excluding the objects reachable from exclude
+func gitListObjects(refs []string, exclude []string) ([]string, error) {
+	args := append([]string{"rev-list", "--objects"}, refs...)
 	for _, e := range exclude {
 		args = append(args, "^"+e)
 	}
@@ -42,6 +45,20 @@ func gitListObjects(ref string, exclude []string) ([]string, error) {
 	return objs, nil
 }
 
+// gitPackObjects writes objs into a new pack at base-<sha1>.pack with its index next to it and returns the sha1
+func gitPackObjects(objs []string, base string) (string, error) {
+	packObjects := exec.Command("git", "pack-objects", "-q", base)
+	packObjects.Dir = thisGitRepo // GIT_DIR
+	packObjects.Stdin = strings.NewReader(strings.Join(objs, "\n") + "\n")
+	var stderr bytes.Buffer
+	packObjects.Stderr = &stderr
+	out, err := packObjects.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "pack-objects failed: %q", stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 func gitFlattenObject(sha1 string) (io.Reader, error) {
 	kind, err := gitCatKind(sha1)
 	if err != nil {
@@ -118,6 +135,91 @@ func gitCatData(sha1, kind string) (io.Reader, error) {
 	return r, nil
 }
 
+// gitCatObject returns kind and content of an object from the local repo
+func gitCatObject(sha1 string) (string, []byte, error) {
+	kind, err := gitCatKind(sha1)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "catObject(%s): kind failed: %s", sha1, kind)
+	}
+	catFile := exec.Command("git", "cat-file", kind, sha1)
+	catFile.Dir = thisGitRepo // GIT_DIR
+	data, err := catFile.Output()
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "catObject(%s) failed", sha1)
+	}
+	return kind, data, nil
+}
+
+// gitCatBatch reads objs from the local repo with a single 'git cat-file --batch' and calls fn for each of them
+func gitCatBatch(objs []string, fn func(sha1, kind string, data []byte) error) error {
+	return catFileBatch("--batch", objs, func(sha1, kind string, size int64, r *bufio.Reader) error {
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errors.Wrapf(err, "catBatch: reading %s failed", sha1)
+		}
+		return fn(sha1, kind, data[:size])
+	})
+}
+
+// gitCatBatchCheck gets the type of each of objs with a single 'git cat-file --batch-check' and calls fn for each of them
+func gitCatBatchCheck(objs []string, fn func(sha1, kind string) error) error {
+	return catFileBatch("--batch-check", objs, func(sha1, kind string, _ int64, _ *bufio.Reader) error {
+		return fn(sha1, kind)
+	})
+}
+
+// catFileBatch runs 'git cat-file <mode>' for objs and calls fn after each header, with the output positioned at the contents.
+// objs missing in the local repo are an error.
+func catFileBatch(mode string, objs []string, fn func(sha1, kind string, size int64, r *bufio.Reader) error) (err error) {
+	if len(objs) == 0 {
+		return nil
+	}
+	catFile := exec.Command("git", "cat-file", mode)
+	catFile.Dir = thisGitRepo // GIT_DIR
+	catFile.Stdin = strings.NewReader(strings.Join(objs, "\n") + "\n")
+	stdout, err := catFile.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "catBatch: stdoutPipe failed")
+	}
+	if err := catFile.Start(); err != nil {
+		return errors.Wrap(err, "catBatch: start failed")
+	}
+	defer func() {
+		if err != nil {
+			// nobody reads the rest of the output, cat-file would block on it forever
+			catFile.Process.Kill()
+			catFile.Wait()
+			return
+		}
+		if err = catFile.Wait(); err != nil {
+			err = errors.Wrapf(err, "cat-file %s failed", mode)
+		}
+	}()
+	br := bufio.NewReader(stdout)
+	for range objs {
+		// "<sha1> <type> <size>\n" followed by "<contents>\n" for --batch, or "<sha1> missing\n"
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "catBatch: reading header failed")
+		}
+		fields := strings.Fields(header)
+		if len(fields) == 2 && fields[1] == "missing" {
+			return errors.Errorf("catBatch: sha1<%s> is missing in the local repo", fields[0])
+		}
+		if len(fields) != 3 {
+			return errors.Errorf("catBatch: unexpected header %q", header)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "catBatch: illegal size in %q", header)
+		}
+		if err := fn(fields[0], fields[1], size, br); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func gitRefHash(ref string) (string, error) {
 	refParse := exec.Command("git", "rev-parse", ref)
 	refParse.Dir = thisGitRepo // GIT_DIR
@@ -125,11 +227,160 @@ func gitRefHash(ref string) (string, error) {
 	return strings.TrimSpace(string(out)), err
 }
 
-func gitIsAncestor(a, ref string) error {
+// gitPeel follows tags until it reaches a non-tag object and returns that, sha1 itself if it isn't a tag
+func gitPeel(sha1 string) (string, error) {
+	revParse := exec.Command("git", "rev-parse", "--verify", "--quiet", sha1+"^{}")
+	revParse.Dir = thisGitRepo // GIT_DIR
+	out, err := revParse.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "peeling %s failed", sha1)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitAddShallow adds commits to the shallow file of the local repo, the boundary of a fetch with depth
+func gitAddShallow(commits []string) error {
+	name := filepath.Join(thisGitRepo, "shallow")
+	old, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "reading shallow file failed")
+	}
+	all := make(map[string]struct{})
+	for _, sha1 := range append(strings.Fields(string(old)), commits...) {
+		all[sha1] = struct{}{}
+	}
+	sorted := make([]string, 0, len(all))
+	for sha1 := range all {
+		sorted = append(sorted, sha1)
+	}
+	sort.Strings(sorted)
+	return writeFileAtomic(name, []byte(strings.Join(sorted, "\n")+"\n"))
+}
+
+// gitConfigGet returns the value of key or an empty string if it isn't set
+func gitConfigGet(key string) (string, error) {
+	config := exec.Command("git", "config", "--get", key)
+	config.Dir = thisGitRepo // GIT_DIR
+	out, err := config.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "git config --get %s failed", key)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitConfigBool returns the boolean key the way git reads it (yes, on, 1 or no value at all are true), or def if it isn't set
+func gitConfigBool(key string, def bool) (bool, error) {
+	config := exec.Command("git", "config", "--bool", "--get", key)
+	config.Dir = thisGitRepo // GIT_DIR
+	out, err := config.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return def, nil
+	}
+	if err != nil {
+		return def, errors.Wrapf(err, "git config --bool --get %s failed", key)
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
+// gitConfigGetURL returns the value of key for url, honoring 'http.<url>.<key>' sections,
+// or an empty string if it isn't set. flags like --bool or --path are passed on to git config.
+func gitConfigGetURL(key, url string, flags ...string) (string, error) {
+	args := append(append([]string{"config"}, flags...), "--get-urlmatch", key, url)
+	config := exec.Command("git", args...)
+	config.Dir = thisGitRepo // GIT_DIR
+	out, err := config.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "git config --get-urlmatch %s %s failed", key, url)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCredential runs 'git credential <action>' with the key=value lines of a credential
+// and returns the lines it answered with
+func gitCredential(action string, cred []string) ([]string, error) {
+	credential := exec.Command("git", "credential", action)
+	credential.Dir = thisGitRepo // GIT_DIR
+	credential.Stdin = strings.NewReader(strings.Join(cred, "\n") + "\n\n")
+	credential.Stderr = os.Stderr
+	out, err := credential.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "git credential %s failed", action)
+	}
+	var lines []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// gitIsAncestor reports whether commit a is an ancestor of ref, both must be in the local repo
+func gitIsAncestor(a, ref string) (bool, error) {
 	mergeBase := exec.Command("git", "merge-base", "--is-ancestor", a, ref)
 	mergeBase.Dir = thisGitRepo // GIT_DIR
-	if out, err := mergeBase.CombinedOutput(); err != nil {
-		return errors.Wrapf(err, "merge-base failed: %q", string(out))
+	out, err := mergeBase.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
 	}
-	return nil
+	if err != nil {
+		return false, errors.Wrapf(err, "merge-base failed: %q", string(out))
+	}
+	return true, nil
+}
+
+// localObjects answers if an object is already in the local object database,
+// loose or packed, using a long running 'git cat-file --batch-check'
+var localObjects struct {
+	sync.Mutex
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+func gitHasObject(sha1 string) (bool, error) {
+	if !isSha1(sha1) {
+		return false, errors.Errorf("hasObject: illegal sha1 %q", sha1)
+	}
+	// cheap check for loose objects first
+	_, err := os.Stat(filepath.Join(thisGitRepo, "objects", sha1[:2], sha1[2:]))
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, errors.Wrapf(err, "hasObject(%s): stat failed", sha1)
+	}
+
+	localObjects.Lock()
+	defer localObjects.Unlock()
+	if localObjects.in == nil {
+		batchCheck := exec.Command("git", "cat-file", "--batch-check")
+		batchCheck.Dir = thisGitRepo // GIT_DIR
+		if localObjects.in, err = batchCheck.StdinPipe(); err != nil {
+			return false, errors.Wrap(err, "hasObject: stdinPipe failed")
+		}
+		stdout, err := batchCheck.StdoutPipe()
+		if err != nil {
+			return false, errors.Wrap(err, "hasObject: stdoutPipe failed")
+		}
+		if err := batchCheck.Start(); err != nil {
+			localObjects.in = nil
+			return false, errors.Wrap(err, "hasObject: batch-check start failed")
+		}
+		localObjects.out = bufio.NewReader(stdout)
+	}
+	if _, err := fmt.Fprintln(localObjects.in, sha1); err != nil {
+		return false, errors.Wrapf(err, "hasObject(%s): writing query failed", sha1)
+	}
+	line, err := localObjects.out.ReadString('\n')
+	if err != nil {
+		return false, errors.Wrapf(err, "hasObject(%s): reading answer failed", sha1)
+	}
+	// "<sha1> missing" or "<sha1> <type> <size>"
+	return !strings.HasSuffix(line, " missing\n"), nil
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestGitCatBatch(t *testing.T) {
+	var err error
+	gitPath, err = exec.LookPath("git")
+	checkFatal(t, err)
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+	defer func(repo string) { thisGitRepo = repo }(thisGitRepo)
+	thisGitRepo = filepath.Join(tmpDir, ".git")
+	gitIn(t, tmpDir, "init", "-q")
+	// more than a pipe buffer, cat-file can't write all of it without a reader
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	var blobs []string
+	for i := 0; i < 4; i++ {
+		name := filepath.Join(tmpDir, "blob")
+		checkFatal(t, ioutil.WriteFile(name, append(big, byte(i)), 0600))
+		blobs = append(blobs, gitIn(t, tmpDir, "hash-object", "-w", name))
+	}
+
+	var kinds []string
+	checkFatal(t, gitCatBatchCheck(blobs, func(sha1, kind string) error {
+		kinds = append(kinds, kind)
+		return nil
+	}))
+	if strings.Join(kinds, " ") != "blob blob blob blob" {
+		t.Errorf("wrong kinds %v", kinds)
+	}
+
+	stop := errors.New("stop")
+	done := make(chan error, 1)
+	go func() {
+		done <- gitCatBatch(blobs, func(sha1, kind string, data []byte) error {
+			if len(data) != len(big)+1 {
+				t.Errorf("%s: got %d bytes", sha1, len(data))
+			}
+			return stop
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != stop {
+			t.Errorf("expected the error of fn, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("gitCatBatch didn't return after an error")
+	}
+
+	missing := strings.Repeat("0", 40)
+	err = gitCatBatch([]string{blobs[0], missing}, func(string, string, []byte) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), missing+"> is missing") {
+		t.Errorf("expected a missing object, got %v", err)
+	}
+}
+
+func TestGitConfigBool(t *testing.T) {
+	var err error
+	gitPath, err = exec.LookPath("git")
+	checkFatal(t, err)
+	tmpDir := mkRandTmpDir(t)
+	defer rmDir(t, tmpDir)
+	defer func(repo string) { thisGitRepo = repo }(thisGitRepo)
+	thisGitRepo = filepath.Join(tmpDir, ".git")
+	gitIn(t, tmpDir, "init", "-q")
+	config := "[ipfs]\n\tbare\n\tyes = yes\n\ton = on\n\tone = 1\n\tno = off\n\tbroken = maybe\n"
+	checkFatal(t, ioutil.WriteFile(filepath.Join(thisGitRepo, "config"), []byte(config), 0600))
+
+	for key, want := range map[string]bool{"bare": true, "yes": true, "on": true, "one": true, "no": false} {
+		if got, err := gitConfigBool("ipfs."+key, !want); err != nil || got != want {
+			t.Errorf("ipfs.%s: got %v (%v), want %v", key, got, err, want)
+		}
+	}
+	if got, err := gitConfigBool("ipfs.unset", true); err != nil || !got {
+		t.Errorf("unset key: got %v (%v), want the default", got, err)
+	}
+	if got, err := gitConfigBool("ipfs.broken", true); err == nil || !got {
+		t.Errorf("broken key: got %v (%v), want the default and an error", got, err)
+	}
+}
+
+func TestGitHasObject_illegal(t *testing.T) {
+	defer func(refs map[string]string) { ref2hash = refs }(ref2hash)
+	// values from a malformed remote, before they reach a path
+	for _, sha1 := range []string{"", "60fde9c", "../../config"} {
+		if _, err := gitHasObject(sha1); err == nil {
+			t.Errorf("%q: expected an error", sha1)
+		}
+		if short := shortSha(sha1); len(short) > 7 {
+			t.Errorf("%q: got %q", sha1, short)
+		}
+	}
+	ref2hash = map[string]string{
+		"refs/tags/v1":    "60fde9c",
+		"refs/tags/v1^{}": "",
+	}
+	if _, err := followedTags(); err == nil {
+		t.Error("expected an error for tags with illegal sha1s")
+	}
+}
@@ -3,10 +3,10 @@ module github.com/cryptix/git-remote-ipfs
 go 1.13
 
 require (
-	github.com/cryptix/exp v0.0.0-20191103140156-9da154296953
 	github.com/cryptix/go v1.5.0
 	github.com/ipfs/go-cid v0.0.3
 	github.com/ipfs/go-ipfs-api v0.0.2
+	github.com/ipfs/go-ipfs-files v0.0.1
 	github.com/jbenet/go-random v0.0.0-20190219211222-123a90aedc0c
 	github.com/multiformats/go-multihash v0.0.9
 	github.com/pkg/errors v0.8.1
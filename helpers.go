@@ -3,25 +3,21 @@ package main
 import (
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 
+	shell "github.com/ipfs/go-ipfs-api"
 	"github.com/pkg/errors"
 )
 
-func fetchFullBareRepo(root string) (string, error) {
-	// TODO: get host from envvar
-	tmpPath := filepath.Join("/", os.TempDir(), root)
-	_, err := os.Stat(tmpPath)
-	switch {
-	case os.IsNotExist(err) || err == nil:
-		if err := ipfsShell.Get(root, tmpPath); err != nil {
-			return "", errors.Wrapf(err, "shell.Get(%s, %s) failed: %s", root, tmpPath, err)
-		}
-		return tmpPath, nil
-	default:
-		return "", errors.Wrap(err, "os.Stat(): unhandled error")
+// ipfsIsNotExist reports whether err says that a path doesn't exist.
+// the api only has the message to tell that apart from other failures.
+func ipfsIsNotExist(err error) bool {
+	if errors.Cause(err) == errNotExist {
+		return true
 	}
+	shellErr, ok := errors.Cause(err).(*shell.Error)
+	return ok && strings.Contains(shellErr.Message, "no link named")
 }
 
 func interrupt() error {
@@ -0,0 +1,202 @@
+// Package pack reads git pack files and their indexes.
+//
+// See https://git-scm.com/docs/pack-format for the format description.
+package pack
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// idxMagic starts every version 2 index file. Version 1 files start with the fanout table directly.
+var idxMagic = []byte{0xff, 't', 'O', 'c'}
+
+// ErrBadIndex is returned for index files that can't be parsed
+var ErrBadIndex = errors.New("pack: malformed index file")
+
+// Index is a parsed pack index file
+type Index struct {
+	Version int
+
+	// PackChecksum is the sha1 of the pack file this index belongs to
+	PackChecksum [sha1.Size]byte
+
+	fanout  [256]uint32
+	hashes  []byte // sorted object names, sha1.Size each
+	crcs    []uint32
+	offsets []uint64
+	sorted  []uint64 // offsets in pack order, to find where an entry ends
+}
+
+// ReadIndex parses a version 1 or 2 pack index from r and verifies its checksum
+func ReadIndex(r io.Reader) (*Index, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "pack: reading index failed")
+	}
+	// trailer: pack checksum and the checksum of the index itself
+	if len(data) < 2*sha1.Size {
+		return nil, errors.Wrap(ErrBadIndex, "too short")
+	}
+	body, sum := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+	if got := sha1.Sum(body); !bytes.Equal(got[:], sum) {
+		return nil, errors.Wrapf(ErrBadIndex, "checksum mismatch: %x != %x", got, sum)
+	}
+
+	var idx Index
+	copy(idx.PackChecksum[:], body[len(body)-sha1.Size:])
+	body = body[:len(body)-sha1.Size]
+
+	idx.Version = 1
+	if bytes.HasPrefix(body, idxMagic) {
+		if len(body) < 8 {
+			return nil, errors.Wrap(ErrBadIndex, "short header")
+		}
+		if v := binary.BigEndian.Uint32(body[4:]); v != 2 {
+			return nil, errors.Wrapf(ErrBadIndex, "unsupported version %d", v)
+		}
+		idx.Version = 2
+		body = body[8:]
+	}
+
+	if len(body) < 256*4 {
+		return nil, errors.Wrap(ErrBadIndex, "short fanout table")
+	}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(body[i*4:])
+		if i > 0 && idx.fanout[i] < idx.fanout[i-1] {
+			return nil, errors.Wrapf(ErrBadIndex, "fanout table not sorted at %d", i)
+		}
+	}
+	body = body[256*4:]
+	n := int(idx.fanout[255])
+
+	switch idx.Version {
+	case 1:
+		// n entries of 4 byte offset followed by the object name
+		const entrySize = 4 + sha1.Size
+		if len(body) != n*entrySize {
+			return nil, errors.Wrapf(ErrBadIndex, "v1: want %d bytes of entries, got %d", n*entrySize, len(body))
+		}
+		idx.hashes = make([]byte, 0, n*sha1.Size)
+		idx.offsets = make([]uint64, n)
+		for i := 0; i < n; i++ {
+			e := body[i*entrySize:]
+			idx.offsets[i] = uint64(binary.BigEndian.Uint32(e))
+			idx.hashes = append(idx.hashes, e[4:entrySize]...)
+		}
+
+	case 2:
+		// n object names, n crc32s, n 4 byte offsets, then the table of 64bit offsets
+		if len(body) < n*(sha1.Size+4+4) {
+			return nil, errors.Wrapf(ErrBadIndex, "v2: short tables for %d objects", n)
+		}
+		idx.hashes = body[:n*sha1.Size]
+		body = body[n*sha1.Size:]
+		idx.crcs = make([]uint32, n)
+		for i := range idx.crcs {
+			idx.crcs[i] = binary.BigEndian.Uint32(body[i*4:])
+		}
+		body = body[n*4:]
+		small, large := body[:n*4], body[n*4:]
+		if len(large)%8 != 0 {
+			return nil, errors.Wrapf(ErrBadIndex, "v2: large offset table has %d bytes", len(large))
+		}
+		idx.offsets = make([]uint64, n)
+		for i := range idx.offsets {
+			o := binary.BigEndian.Uint32(small[i*4:])
+			if o&0x80000000 == 0 {
+				idx.offsets[i] = uint64(o)
+				continue
+			}
+			// the MSB marks an index into the table of 64bit offsets
+			li := int(o &^ 0x80000000)
+			if (li+1)*8 > len(large) {
+				return nil, errors.Wrapf(ErrBadIndex, "v2: large offset %d out of range", li)
+			}
+			idx.offsets[i] = binary.BigEndian.Uint64(large[li*8:])
+		}
+	}
+
+	for i := 1; i < n; i++ {
+		if bytes.Compare(idx.hash(i-1), idx.hash(i)) >= 0 {
+			return nil, errors.Wrapf(ErrBadIndex, "object names not sorted at %d", i)
+		}
+	}
+	idx.sorted = append([]uint64(nil), idx.offsets...)
+	sort.Slice(idx.sorted, func(i, j int) bool { return idx.sorted[i] < idx.sorted[j] })
+	return &idx, nil
+}
+
+// Len returns the number of objects in the pack
+func (idx *Index) Len() int { return len(idx.offsets) }
+
+func (idx *Index) hash(i int) []byte { return idx.hashes[i*sha1.Size : (i+1)*sha1.Size] }
+
+// find returns the position of the hex encoded sha1 in the sorted object names or -1
+func (idx *Index) find(sha1hex string) int {
+	want, err := hex.DecodeString(sha1hex)
+	if err != nil || len(want) != sha1.Size {
+		return -1
+	}
+	// the fanout table narrows the search to the objects with the same first byte
+	lo := 0
+	if want[0] > 0 {
+		lo = int(idx.fanout[want[0]-1])
+	}
+	hi := int(idx.fanout[want[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.hash(lo+i), want) >= 0
+	})
+	if i < hi && bytes.Equal(idx.hash(i), want) {
+		return i
+	}
+	return -1
+}
+
+// Contains reports whether the pack has the object with the hex encoded sha1
+func (idx *Index) Contains(sha1hex string) bool { return idx.find(sha1hex) >= 0 }
+
+// Offset returns the position of the object in the pack file
+func (idx *Index) Offset(sha1hex string) (uint64, bool) {
+	i := idx.find(sha1hex)
+	if i < 0 {
+		return 0, false
+	}
+	return idx.offsets[i], true
+}
+
+// EntryEnd returns the offset of the entry following the one at offset.
+// ok is false for the last entry, which is followed by the pack checksum.
+func (idx *Index) EntryEnd(offset uint64) (end uint64, ok bool) {
+	i := sort.Search(len(idx.sorted), func(i int) bool { return idx.sorted[i] > offset })
+	if i == len(idx.sorted) {
+		return 0, false
+	}
+	return idx.sorted[i], true
+}
+
+// CRC32 returns the checksum of the packed object data. Only version 2 indexes have them.
+func (idx *Index) CRC32(sha1hex string) (uint32, bool) {
+	i := idx.find(sha1hex)
+	if i < 0 || idx.crcs == nil {
+		return 0, false
+	}
+	return idx.crcs[i], true
+}
+
+// Objects returns the hex encoded names of all objects, in sorted order
+func (idx *Index) Objects() []string {
+	objs := make([]string, idx.Len())
+	for i := range objs {
+		objs[i] = hex.EncodeToString(idx.hash(i))
+	}
+	return objs
+}
@@ -0,0 +1,157 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// makePack creates a repo with a few objects and returns the path of a pack with all of them.
+// packArgs are passed to git pack-objects.
+func makePack(t *testing.T, packArgs ...string) (dir, pack string) {
+	dir, err := ioutil.TempDir("", "git-remote-ipfs-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %s\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("", "init", "-q")
+	for i := 0; i < 20; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%d", i%7))
+		if err := ioutil.WriteFile(name, bytes.Repeat([]byte(fmt.Sprintf("line %d\n", i)), 100+i), 0600); err != nil {
+			t.Fatal(err)
+		}
+		git("", "add", ".")
+		git("", "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	objs := git("", "rev-list", "--objects", "HEAD")
+	var names bytes.Buffer
+	for _, l := range strings.Split(objs, "\n") {
+		fmt.Fprintln(&names, strings.Split(l, " ")[0])
+	}
+	sum := git(names.String(), append([]string{"pack-objects", "-q"}, append(packArgs, filepath.Join(dir, "test"))...)...)
+	return dir, filepath.Join(dir, "test-"+sum+".pack")
+}
+
+type showIndexEntry struct {
+	offset uint64
+	crc    uint32
+}
+
+func showIndex(t *testing.T, idxFile string) map[string]showIndexEntry {
+	f, err := os.Open(idxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cmd := exec.Command("git", "show-index")
+	cmd.Stdin = f
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]showIndexEntry)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		off, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e = showIndexEntry{offset: off}
+		if len(fields) == 3 { // v2 has "offset sha1 (crc32)"
+			crc, err := strconv.ParseUint(strings.Trim(fields[2], "()"), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.crc = uint32(crc)
+		}
+		entries[fields[1]] = e
+	}
+	return entries
+}
+
+func TestReadIndex(t *testing.T) {
+	dir, pack := makePack(t)
+	defer os.RemoveAll(dir)
+
+	for _, v := range []string{"1", "2", "2,0x100"} { // the last one forces 64bit offsets
+		idxFile := filepath.Join(dir, "v"+v+".idx")
+		out, err := exec.Command("git", "index-pack", "--index-version="+v, "-o", idxFile, pack).CombinedOutput()
+		if err != nil {
+			t.Fatalf("index-pack %s failed: %s\n%s", v, err, out)
+		}
+		want := showIndex(t, idxFile)
+
+		f, err := os.Open(idxFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := ReadIndex(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("v%s: %+v", v, err)
+		}
+		if idx.Version != int(v[0]-'0') {
+			t.Errorf("v%s: wrong version %d", v, idx.Version)
+		}
+		if idx.Len() != len(want) {
+			t.Fatalf("v%s: wrong number of objects %d != %d", v, idx.Len(), len(want))
+		}
+		for _, obj := range idx.Objects() {
+			w, ok := want[obj]
+			if !ok {
+				t.Fatalf("v%s: unexpected object %s", v, obj)
+			}
+			off, ok := idx.Offset(obj)
+			if !ok || off != w.offset {
+				t.Errorf("v%s: %s: wrong offset %d != %d", v, obj, off, w.offset)
+			}
+			crc, ok := idx.CRC32(obj)
+			if ok != (idx.Version == 2) || crc != w.crc {
+				t.Errorf("v%s: %s: wrong crc %x != %x", v, obj, crc, w.crc)
+			}
+		}
+		for _, missing := range []string{"0000000000000000000000000000000000000000", "ffffffffffffffffffffffffffffffffffffffff", "abc", "not hex"} {
+			if idx.Contains(missing) {
+				t.Errorf("v%s: claims to have %s", v, missing)
+			}
+		}
+	}
+}
+
+func TestReadIndex_broken(t *testing.T) {
+	dir, pack := makePack(t)
+	defer os.RemoveAll(dir)
+	idx, err := ioutil.ReadFile(strings.TrimSuffix(pack, ".pack") + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), idx...)
+	flipped[len(flipped)/2] ^= 0xff
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"truncated": idx[:len(idx)-1],
+		"flipped":   flipped,
+	} {
+		if _, err := ReadIndex(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
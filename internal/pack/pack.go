@@ -0,0 +1,228 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// ObjectType is the type of a pack entry
+type ObjectType byte
+
+// pack entry types, 5 is reserved
+const (
+	Commit   ObjectType = 1
+	Tree     ObjectType = 2
+	Blob     ObjectType = 3
+	Tag      ObjectType = 4
+	OfsDelta ObjectType = 6
+	RefDelta ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case Commit:
+		return "commit"
+	case Tree:
+		return "tree"
+	case Blob:
+		return "blob"
+	case Tag:
+		return "tag"
+	case OfsDelta:
+		return "ofs-delta"
+	case RefDelta:
+		return "ref-delta"
+	}
+	return "unknown"
+}
+
+// IsDelta reports whether the entry needs a base object to be reconstructed
+func (t ObjectType) IsDelta() bool { return t == OfsDelta || t == RefDelta }
+
+// ErrBadEntry is returned for pack entries that can't be parsed
+var ErrBadEntry = errors.New("pack: malformed entry")
+
+// EntryHeader describes an object stored in a pack file
+type EntryHeader struct {
+	Type ObjectType
+	Size int64 // of the inflated data, the delta itself for delta entries
+
+	// BaseOffset is the distance back from the start of this entry to its base for OfsDelta entries
+	BaseOffset uint64
+	// BaseRef is the hex encoded name of the base for RefDelta entries
+	BaseRef string
+}
+
+// ReadEntry reads the entry header and the inflated data from r, which is positioned at the start of an entry
+func ReadEntry(r io.Reader) (*EntryHeader, []byte, error) {
+	br := bufio.NewReader(r)
+	hdr, err := readEntryHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "pack: zlib reader for %s entry failed", hdr.Type)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(zr, hdr.Size+1))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "pack: inflating %s entry failed", hdr.Type)
+	}
+	if int64(len(data)) != hdr.Size {
+		return nil, nil, errors.Wrapf(ErrBadEntry, "%s entry has %d bytes, header says %d", hdr.Type, len(data), hdr.Size)
+	}
+	return hdr, data, nil
+}
+
+func readEntryHeader(br *bufio.Reader) (*EntryHeader, error) {
+	c, err := br.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(ErrBadEntry, "reading type failed")
+	}
+	hdr := &EntryHeader{
+		Type: ObjectType((c >> 4) & 7),
+		Size: int64(c & 0x0f),
+	}
+	// size is a little endian varint, the first byte holds 4 bits of it
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 60 {
+			return nil, errors.Wrap(ErrBadEntry, "size overflow")
+		}
+		if c, err = br.ReadByte(); err != nil {
+			return nil, errors.Wrap(ErrBadEntry, "reading size failed")
+		}
+		hdr.Size |= int64(c&0x7f) << shift
+	}
+
+	switch hdr.Type {
+	case Commit, Tree, Blob, Tag:
+	case OfsDelta:
+		// big endian varint where each continuation adds one, to avoid redundant encodings
+		if c, err = br.ReadByte(); err != nil {
+			return nil, errors.Wrap(ErrBadEntry, "reading base offset failed")
+		}
+		off := uint64(c & 0x7f)
+		for c&0x80 != 0 {
+			if off >= 1<<56 {
+				return nil, errors.Wrap(ErrBadEntry, "base offset overflow")
+			}
+			if c, err = br.ReadByte(); err != nil {
+				return nil, errors.Wrap(ErrBadEntry, "reading base offset failed")
+			}
+			off = ((off + 1) << 7) | uint64(c&0x7f)
+		}
+		hdr.BaseOffset = off
+	case RefDelta:
+		var ref [sha1.Size]byte
+		if _, err := io.ReadFull(br, ref[:]); err != nil {
+			return nil, errors.Wrap(ErrBadEntry, "reading base ref failed")
+		}
+		hdr.BaseRef = hex.EncodeToString(ref[:])
+	default:
+		return nil, errors.Wrapf(ErrBadEntry, "illegal type %d", hdr.Type)
+	}
+	return hdr, nil
+}
+
+// ApplyDelta reconstructs an object from its base and a delta
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	srcSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != uint64(len(base)) {
+		return nil, errors.Wrapf(ErrBadEntry, "delta: base has %d bytes, expected %d", len(base), srcSize)
+	}
+	dstSize, err := readDeltaSize(r)
+	if err != nil {
+		return nil, err
+	}
+	// the size comes from the pack: every instruction takes a byte and adds at most the base or a byte to the result
+	most := len(base)
+	if most == 0 {
+		most = 1
+	}
+	if dstSize/uint64(most) > uint64(r.Len()) {
+		return nil, errors.Wrapf(ErrBadEntry, "delta: result of %d bytes can't come from %d bytes", dstSize, len(delta))
+	}
+	// a result much bigger than its base is rare, the rest is grown while applying
+	capacity := dstSize
+	if limit := uint64(len(base) + len(delta)); capacity > limit {
+		capacity = limit
+	}
+	out := make([]byte, 0, capacity)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch {
+		case op&0x80 != 0:
+			// copy from base: the low 7 bits say which offset and size bytes follow
+			var off, size uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				b, err := r.ReadByte()
+				if err != nil {
+					return nil, errors.Wrap(ErrBadEntry, "delta: truncated copy instruction")
+				}
+				if i < 4 {
+					off |= uint64(b) << (8 * i)
+				} else {
+					size |= uint64(b) << (8 * (i - 4))
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if off+size > uint64(len(base)) {
+				return nil, errors.Wrapf(ErrBadEntry, "delta: copy %d+%d out of base bounds %d", off, size, len(base))
+			}
+			if uint64(len(out))+size > dstSize {
+				return nil, errors.Wrapf(ErrBadEntry, "delta: result exceeds %d bytes", dstSize)
+			}
+			out = append(out, base[off:off+size]...)
+		case op != 0:
+			// insert the next op bytes literally
+			if int(op) > r.Len() {
+				return nil, errors.Wrap(ErrBadEntry, "delta: truncated insert instruction")
+			}
+			if uint64(len(out))+uint64(op) > dstSize {
+				return nil, errors.Wrapf(ErrBadEntry, "delta: result exceeds %d bytes", dstSize)
+			}
+			lit := make([]byte, op)
+			r.Read(lit)
+			out = append(out, lit...)
+		default:
+			return nil, errors.Wrap(ErrBadEntry, "delta: reserved instruction 0")
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, errors.Wrapf(ErrBadEntry, "delta: result has %d bytes, expected %d", len(out), dstSize)
+	}
+	return out, nil
+}
+
+func readDeltaSize(r io.ByteReader) (uint64, error) {
+	var size uint64
+	for shift := uint(0); ; shift += 7 {
+		if shift > 63 {
+			return 0, errors.Wrap(ErrBadEntry, "delta: size overflow")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, errors.Wrap(ErrBadEntry, "delta: truncated size")
+		}
+		size |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return size, nil
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package pack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// resolve reconstructs the object at offset by reading only its own byte range and the ones of its bases
+func resolve(t *testing.T, packData []byte, idx *Index, offset uint64) (ObjectType, []byte) {
+	end, ok := idx.EntryEnd(offset)
+	if !ok {
+		end = uint64(len(packData) - 20)
+	}
+	hdr, data, err := ReadEntry(bytes.NewReader(packData[offset:end]))
+	if err != nil {
+		t.Fatalf("entry at %d: %+v", offset, err)
+	}
+	var baseOffset uint64
+	switch hdr.Type {
+	case OfsDelta:
+		baseOffset = offset - hdr.BaseOffset
+	case RefDelta:
+		if baseOffset, ok = idx.Offset(hdr.BaseRef); !ok {
+			t.Fatalf("entry at %d: base %s not in pack", offset, hdr.BaseRef)
+		}
+	default:
+		return hdr.Type, data
+	}
+	typ, base := resolve(t, packData, idx, baseOffset)
+	obj, err := ApplyDelta(base, data)
+	if err != nil {
+		t.Fatalf("entry at %d: %+v", offset, err)
+	}
+	return typ, obj
+}
+
+func TestReadEntry(t *testing.T) {
+	for _, packArgs := range [][]string{nil, {"--delta-base-offset"}} {
+		dir, packFile := makePack(t, packArgs...)
+		packData, err := ioutil.ReadFile(packFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(strings.TrimSuffix(packFile, ".pack") + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := ReadIndex(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var deltas int
+		for _, obj := range idx.Objects() {
+			off, _ := idx.Offset(obj)
+			if hdr, _, err := ReadEntry(bytes.NewReader(packData[off:])); err == nil && hdr.Type.IsDelta() {
+				deltas++
+			}
+			typ, data := resolve(t, packData, idx, off)
+
+			cmd := exec.Command("git", "cat-file", typ.String(), obj)
+			cmd.Dir = dir
+			want, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("%v: cat-file %s %s failed: %s", packArgs, typ, obj, err)
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf("%v: %s %s differs", packArgs, typ, obj)
+			}
+		}
+		if deltas == 0 {
+			t.Errorf("%v: test pack has no deltas", packArgs)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestApplyDelta_broken(t *testing.T) {
+	base := []byte("hello world")
+	for name, delta := range map[string][]byte{
+		"empty":          nil,
+		"wrong src size": {5, 5, 0x05, 'h', 'e', 'l', 'l', 'o'},
+		"copy oob":       {11, 5, 0x91, 10, 5},
+		"short insert":   {11, 5, 0x05, 'h'},
+		"reserved":       {11, 0, 0x00},
+		"wrong dst size": {11, 6, 0x90, 5},
+		"long result":    {11, 4, 0x90, 5},
+		"huge dst size":  {11, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x90, 5},
+	} {
+		if _, err := ApplyDelta(base, delta); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	got, err := ApplyDelta(base, []byte{11, 8, 0x90, 5, 0x03, '!', '!', '!'})
+	if err != nil || string(got) != "hello!!!" {
+		t.Errorf("simple delta failed: %q %v", got, err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+// ipnsRemote is set for remotes with an /ipns/ url.
+// Pushes republish the name instead of pointing the remote url to the new root.
+var ipnsRemote *ipnsName
+
+type ipnsName struct {
+	name string // key hash or dnslink domain
+	sub  string // path of the repo below the published root, empty if it is the root itself
+	root string // the published root this session works on
+}
+
+// parseIPNS splits an /ipns/<name>/<sub> path
+func parseIPNS(p string) *ipnsName {
+	parts := splitPath(strings.TrimPrefix(p, "/ipns/"))
+	if len(parts) == 0 {
+		return nil
+	}
+	return &ipnsName{name: parts[0], sub: strings.Join(parts[1:], "/")}
+}
+
+// resolve looks up the root the name points to now, bypassing the cache of the daemon
+func (n *ipnsName) resolve() (string, error) {
+	p, err := backend.ResolveName(n.name)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving /ipns/%s failed", n.name)
+	}
+	// the record can point to a path below a root
+	root, err := backend.ResolvePath(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving %s of /ipns/%s failed", p, n.name)
+	}
+	return root, nil
+}
+
+// repoPath returns the path of the repo in the resolved root.
+// Reading from it instead of the name sees the same refs and objects for the whole session.
+func (n *ipnsName) repoPath() string {
+	return path.Join("/ipfs", n.root, n.sub)
+}
+
+// errNameMoved is the status of refs that weren't pushed
+// because someone else republished the name since this session resolved it
+var errNameMoved = errors.New("fetch first")
+
+// linkRepo returns the published root with repoRoot and its cumulative size linked at sub, the directories are written with put
+func (n *ipnsName) linkRepo(repoRoot string, size uint64, put dirPutter) (string, error) {
+	patch := newRootPatch(n.root)
+	patch.addLink(n.sub, repoRoot, size)
+	root, _, err := patch.applyWith(put)
+	if err != nil {
+		return "", errors.Wrapf(err, "linking the repo into %s failed", n.root)
+	}
+	return root, nil
+}
+
+// publish links the new repo root into the published root and republishes the name with it
+func (n *ipnsName) publish(repoRoot string) error {
+	key, err := n.key()
+	if err != nil {
+		return err
+	}
+	// publishing would throw away whatever was published in between
+	current, err := n.resolve()
+	if err != nil {
+		return err
+	}
+	if current != n.root {
+		log.Log("name", n.name, "resolved", n.root, "now", current, "msg", "name was republished")
+		return errNameMoved
+	}
+	newRoot := repoRoot
+	if n.sub != "" {
+		size, err := backend.Size(repoRoot)
+		if err != nil {
+			return err
+		}
+		if newRoot, err = n.linkRepo(repoRoot, size, backend.PutDir); err != nil {
+			return err
+		}
+	}
+	if err := backend.Publish("/ipfs/"+newRoot, key); err != nil {
+		return errors.Wrapf(err, "publishing %s with key %s failed", newRoot, key)
+	}
+	n.root = newRoot
+	ipfsRepoPath = n.repoPath()
+	log.Log("name", n.name, "key", key, "root", newRoot, "msg", "republished")
+	return nil
+}
+
+// maxIPNSRebases limits how often a push is repeated on top of a name that keeps moving
+const maxIPNSRebases = 3
+
+// ipnsRebase reports whether a push is repeated on the republished name if none of its refs were changed there,
+// configured with 'git config ipfs.ipnsRebase true'
+func ipnsRebase() bool {
+	rebase, err := gitConfigBool("ipfs.ipnsRebase", false)
+	if err != nil {
+		log.Log("err", err, "msg", "reading ipfs.ipnsRebase failed - not rebasing")
+	}
+	return rebase
+}
+
+// nameMoved reports whether refs were rejected because the name was republished
+func nameMoved(refs []*pushRef) bool {
+	if ipnsRemote == nil {
+		return false
+	}
+	for _, r := range refs {
+		if errors.Cause(r.err) == errNameMoved {
+			return true
+		}
+	}
+	return false
+}
+
+// rebase moves the session to the root the name points to now, if the refs of the push weren't changed there.
+// The refs of that root replace the listed ones so that the push can be repeated on top of it.
+func (n *ipnsName) rebase(refs []*pushRef) (bool, error) {
+	current, err := n.resolve()
+	if err != nil {
+		return false, err
+	}
+	oldRepo, err := n.resolveRepo(n.root)
+	if err != nil {
+		return false, err
+	}
+	newRepo, err := n.resolveRepo(current)
+	if err != nil {
+		return false, err
+	}
+	oldPatch, newPatch := newRootPatch(oldRepo), newRootPatch(newRepo)
+	for _, r := range refs {
+		before, err := remoteRef(oldPatch, r.dst)
+		if err != nil {
+			return false, err
+		}
+		after, err := remoteRef(newPatch, r.dst)
+		if err != nil {
+			return false, err
+		}
+		if before != after {
+			log.Log("ref", r.dst, "before", shortSha(before), "now", shortSha(after), "msg", "changed on the republished name")
+			return false, nil
+		}
+	}
+	newRefs := make(map[string]string)
+	if newRepo != "" {
+		info, err := readRootFile(newPatch, "info/refs")
+		if err != nil {
+			return false, err
+		}
+		if info == nil {
+			// can't tell which refs are there without listing the refs directory again
+			return false, nil
+		}
+		if err := readInfoRefs(bytes.NewReader(info), newRefs); err != nil {
+			return false, err
+		}
+	}
+	log.Log("name", n.name, "root", current, "msg", "rebasing push")
+	n.root = current
+	ipfsRepoPath = n.repoPath()
+	ref2hash = newRefs
+	return true, nil
+}
+
+// resolveRepo returns the repo in the published root, "" if it doesn't exist there
+func (n *ipnsName) resolveRepo(root string) (string, error) {
+	repo, err := backend.ResolvePath(path.Join("/ipfs", root, n.sub))
+	if ipfsIsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving the repo in %s failed", root)
+	}
+	return repo, nil
+}
+
+// key returns the name of the local key that publishes the name,
+// 'git config remote.<name>.ipfsKey' or the key that matches it
+func (n *ipnsName) key() (string, error) {
+	configured, err := gitConfigGet("remote." + thisGitRemote + ".ipfsKey")
+	if err != nil {
+		return "", err
+	}
+	want, err := ipnsKeyHash(n.name)
+	if err != nil {
+		return "", errors.Errorf("can't publish /ipns/%s, it is not the hash of a key", n.name)
+	}
+	keys, err := backend.Keys()
+	if err != nil {
+		return "", errors.Wrap(err, "listing keys failed")
+	}
+	for _, k := range keys {
+		if configured != "" && k.Name != configured {
+			continue
+		}
+		// the same key can be written as peer id or as cid
+		if h, err := ipnsKeyHash(k.Id); err == nil && bytes.Equal(h, want) {
+			return k.Name, nil
+		}
+	}
+	if configured != "" {
+		return "", errors.Errorf("key %s doesn't publish /ipns/%s", configured, n.name)
+	}
+	return "", errors.Errorf("no local key publishes /ipns/%s, see remote.%s.ipfsKey", n.name, thisGitRemote)
+}
+
+// ipnsKeyHash returns the multihash of a key, written as cid or as base58 peer id
+func ipnsKeyHash(name string) (multihash.Multihash, error) {
+	if c, err := cid.Decode(name); err == nil {
+		return c.Hash(), nil
+	}
+	return multihash.FromB58String(name)
+}
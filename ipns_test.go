@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+)
+
+func TestParseIPNS(t *testing.T) {
+	for _, tc := range []struct {
+		path, name, sub string
+	}{
+		{"/ipns/example.com", "example.com", ""},
+		{"/ipns/QmWmTYBhhq8qebmvA7UtNZDG8RJECbwKqno89xKcSogEZ3/repo.git", "QmWmTYBhhq8qebmvA7UtNZDG8RJECbwKqno89xKcSogEZ3", "repo.git"},
+		{"/ipns/example.com/git/repo.git/", "example.com", "git/repo.git"},
+	} {
+		n := parseIPNS(tc.path)
+		if n.name != tc.name || n.sub != tc.sub {
+			t.Errorf("%s: got %q %q, want %q %q", tc.path, n.name, n.sub, tc.name, tc.sub)
+		}
+	}
+}
+
+func TestIPNSKeyHash(t *testing.T) {
+	const peerID = "QmWmTYBhhq8qebmvA7UtNZDG8RJECbwKqno89xKcSogEZ3"
+	want, err := ipnsKeyHash(peerID)
+	checkFatal(t, err)
+	// the same key as libp2p-key cid
+	asCid := cid.NewCidV1(0x72, want).String()
+	got, err := ipnsKeyHash(asCid)
+	checkFatal(t, err)
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s and %s are different keys", peerID, asCid)
+	}
+	if _, err := ipnsKeyHash("example.com"); err == nil {
+		t.Error("expected error for a domain")
+	}
+}
+
+func TestIPNSLinkRepo_dry(t *testing.T) {
+	defer func(b Backend) { backend = b }(backend)
+	s := newBlockStore("")
+	backend = s
+	head := mustAdd(t, s, "ref: refs/heads/master\n")
+	repo, _, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData})
+	checkFatal(t, err)
+	published, _, err := s.PutDir(&shell.IpfsObject{Data: unixfsDirData, Links: []shell.ObjectLink{{Name: "repo.git", Hash: repo}}})
+	checkFatal(t, err)
+	n := &ipnsName{name: "example.com", sub: "repo.git", root: published}
+
+	// a dry run only hashes the new repo, its blocks aren't stored
+	patch := newRootPatch(repo)
+	headSize, err := s.Size(head)
+	checkFatal(t, err)
+	patch.addLink("HEAD", head, headSize)
+	newRepo, size, err := patch.dryApply()
+	checkFatal(t, err)
+	dry, err := n.linkRepo(newRepo, size, hashDir)
+	checkFatal(t, err)
+	if dry == newRepo || dry == published {
+		t.Fatalf("the published root isn't the one with the new repo: %s", dry)
+	}
+
+	patch = newRootPatch(repo)
+	patch.addLink("HEAD", head, headSize)
+	stored, err := patch.apply()
+	checkFatal(t, err)
+	storedSize, err := s.Size(stored)
+	checkFatal(t, err)
+	if stored != newRepo || storedSize != size {
+		t.Errorf("dry run hashed %s (%d), push stored %s (%d)", newRepo, size, stored, storedSize)
+	}
+	wet, err := n.linkRepo(stored, storedSize, s.PutDir)
+	checkFatal(t, err)
+	if wet != dry {
+		t.Errorf("dry run would publish %s, push publishes %s", dry, wet)
+	}
+}
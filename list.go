@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
@@ -12,26 +13,36 @@ import (
 )
 
 func listInfoRefs(forPush bool) error {
-	refsCat, err := ipfsShell.Cat(filepath.Join(ipfsRepoPath, "info", "refs"))
+	refsCat, err := backend.Cat(filepath.Join(ipfsRepoPath, "info", "refs"))
 	if err != nil {
 		return errors.Wrapf(err, "failed to cat info/refs from %s", ipfsRepoPath)
 	}
-	s := bufio.NewScanner(refsCat)
+	defer refsCat.Close()
+	return readInfoRefs(refsCat, ref2hash)
+}
+
+// readInfoRefs adds the "<sha1>\t<ref>" lines of an info/refs file to refs, skipping refs without a full sha1
+func readInfoRefs(r io.Reader, refs map[string]string) error {
+	s := bufio.NewScanner(r)
 	for s.Scan() {
 		hashRef := strings.Split(s.Text(), "\t")
 		if len(hashRef) != 2 {
 			return errors.Errorf("processing info/refs: what is this: %v", hashRef)
 		}
-		ref2hash[hashRef[1]] = hashRef[0]
+		if !isSha1(hashRef[0]) {
+			log.Log("err", errors.Errorf("illegal sha1 %q", hashRef[0]), "ref", hashRef[1], "msg", "skipping ref of info/refs")
+			continue
+		}
+		refs[hashRef[1]] = hashRef[0]
 	}
 	if err := s.Err(); err != nil {
-		return errors.Wrapf(err, "ipfs.Cat(info/refs) scanner error")
+		return errors.Wrapf(err, "info/refs scanner error")
 	}
 	return nil
 }
 
 func listHeadRef() (string, error) {
-	headCat, err := ipfsShell.Cat(filepath.Join(ipfsRepoPath, "HEAD"))
+	headCat, err := backend.Cat(filepath.Join(ipfsRepoPath, "HEAD"))
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to cat HEAD from %s", ipfsRepoPath)
 	}
@@ -59,7 +70,7 @@ func listIterateRefs(forPush bool) error {
 		}
 		log.Log("event", "debug", "name", info.Name, "msg", "iterateRefs: walked to", "p", p)
 		if info.Type == 2 {
-			rc, err := ipfsShell.Cat(p)
+			rc, err := backend.Cat(p)
 			if err != nil {
 				return errors.Wrapf(err, "walk(%s) cat ref failed", p)
 			}
@@ -72,6 +83,10 @@ func listIterateRefs(forPush bool) error {
 			}
 			sha1 := strings.TrimSpace(string(data))
 			refName := strings.TrimPrefix(p, ipfsRepoPath+"/")
+			if !isSha1(sha1) {
+				log.Log("err", errors.Errorf("illegal sha1 %q", sha1), "ref", refName, "msg", "iterateRefs: skipping ref")
+				return nil
+			}
 			ref2hash[refName] = sha1
 			log.Log("event", "debug", "refMap", ref2hash, "msg", "ref2hash map updated")
 		}
@@ -96,7 +111,7 @@ func walk(path string, info *shell.LsLink, walkFn WalkFunc) error {
 	if info.Type != 1 {
 		return nil
 	}
-	list, err := ipfsShell.List(path)
+	list, err := backend.List(path)
 	if err != nil {
 		log.Log("msg", "walk list failed", "err", err)
 
@@ -115,7 +130,7 @@ func walk(path string, info *shell.LsLink, walkFn WalkFunc) error {
 }
 
 func Walk(root string, walkFn WalkFunc) error {
-	list, err := ipfsShell.List(root)
+	list, err := backend.List(root)
 	if err != nil {
 		log.Log("msg", "walk root failed", "err", err)
 		return walkFn(root, nil, err)
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cryptix/go/logging"
+	"github.com/cryptix/go/logging/logtest"
+)
+
+func TestReadInfoRefs(t *testing.T) {
+	defer func(l logging.Interface) { log = l }(log)
+	log, _ = logtest.KitLogger("TestReadInfoRefs", t)
+
+	const sha1 = "60fde9c2310b0d4cad4dab8d126b04387efba289"
+	info := strings.Join([]string{
+		sha1 + "\trefs/heads/master",
+		"60fde9c\trefs/heads/short",
+		"\trefs/heads/empty",
+		strings.ToUpper(sha1) + "\trefs/heads/upper",
+		"../../../../etc/passwd0123456789abcdef01\trefs/heads/path",
+	}, "\n")
+	refs := make(map[string]string)
+	checkFatal(t, readInfoRefs(strings.NewReader(info), refs))
+	if len(refs) != 1 || refs["refs/heads/master"] != sha1 {
+		t.Errorf("got refs %v", refs)
+	}
+	if err := readInfoRefs(strings.NewReader("no tab"), refs); err == nil {
+		t.Error("expected an error for a line without a ref")
+	}
+}
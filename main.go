@@ -3,9 +3,16 @@ git-remote-helper implements a git-remote helper that uses the ipfs transport.
 
 TODO
 
-Currently assumes a IPFS Daemon at localhost:5001
+The api of the daemon is the first one set of 'git config remote.<name>.ipfsApi', 'git config ipfs.api',
+the IPFS_API env var and the api file in IPFS_PATH (~/.ipfs), otherwise localhost:5001.
+Addresses are host:port, urls or multiaddrs like /ip4/127.0.0.1/tcp/5001, /dns/$host/tcp/5001 or /unix/$socket.
+An api behind an https proxy (https://$host or /dns/$host/tcp/443/https) is verified with the http.sslCAInfo,
+http.sslVerify and http.sslCert settings of git. When it answers 401 the credentials come from 'git credential fill'.
+With GIT_REMOTE_IPFS_STORE=<dir> the blocks are kept in that directory instead, no daemon needed.
+To clone and fetch without a daemon, set a gateway with 'git config remote.<name>.ipfsGateway', 'git config ipfs.gateway'
+or IPFS_GATEWAY. Every block it sends is checked against its cid, it can't push or resolve ipns names.
 
-Not completed: new Push (issue #2), IPNS, URLs like fs:/ipfs/.. (issue #3), embedded IPFS node
+Not completed: URLs like fs:/ipfs/.. (issue #3), embedded IPFS node
 
 ...
 
@@ -15,6 +22,25 @@ Not completed: new Push (issue #2), IPNS, URLs like fs:/ipfs/.. (issue #3), embe
  $ git push origin
  => clone-able as ipfs://ipfs/$newHash/repo.git
 
+Pushing to a path that doesn't exist yet, or to an empty directory, creates a bare repo there
+with HEAD, refs/, objects/ and info/. HEAD points to master, or else the first branch pushed.
+
+ $ git push ipfs://ipfs/QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn/repo.git master
+ => clone-able as ipfs://ipfs/$newHash/repo.git
+
+Repos move to machines without a network as car files. ipfs+car:// urls read from them, for that the helper
+also has to be installed as git-remote-ipfs+car, a link to git-remote-ipfs will do. The repo is a path below the root of the car.
+
+ $ git-remote-ipfs export-car ipfs://ipfs/$hash repo.car
+ $ git clone ipfs+car:///media/usb/repo.car/repo.git
+
+Pushing to an IPNS name republishes it with a local key, the url stays the same.
+The key is found by its hash or set with 'git config remote.<name>.ipfsKey <key>'.
+
+ $ git clone ipfs://ipns/$key/repo.git
+ $ git push origin
+ => clone-able as ipfs://ipns/$key/repo.git
+
 Links
 
 https://ipfs.io
@@ -41,7 +67,6 @@ import (
 
 	"github.com/cryptix/git-remote-ipfs/internal/path"
 	"github.com/cryptix/go/logging"
-	shell "github.com/ipfs/go-ipfs-api"
 	"github.com/pkg/errors"
 )
 
@@ -50,7 +75,11 @@ supports:
 
 * ipfs://ipfs/$hash/path..
 * ipfs:///ipfs/$hash/path..
+* ipfs://ipns/$name/path..
+* ipfs:///ipns/$name/path..
+* ipfs+car:///$file.car/path..
 
+git-remote-ipfs export-car <root> <out.car>
 `
 
 func usage() {
@@ -61,7 +90,7 @@ func usage() {
 var (
 	ref2hash = make(map[string]string)
 
-	ipfsShell     = shell.NewShell("localhost:5001")
+	backend       Backend
 	ipfsRepoPath  string
 	thisGitRepo   string
 	thisGitRemote string
@@ -78,7 +107,24 @@ func logFatal(msg string) {
 func main() {
 	// logging
 	logging.SetupLogging(nil)
-	log = logging.Logger("git-remote-ipfs")
+	log = verbosityLogger{logging.Logger("git-remote-ipfs")}
+
+	if len(os.Args) > 1 && os.Args[1] == "export-car" {
+		if len(os.Args) != 4 {
+			usage()
+		}
+		// outside of a repo the backend is configured globally
+		thisGitRepo = os.Getenv("GIT_DIR")
+		var err error
+		backend, err = newBackend()
+		check(err)
+		root := urlPath(os.Args[2])
+		if !strings.HasPrefix(root, "/") {
+			root = "/ipfs/" + root
+		}
+		check(exportCARFile(root, os.Args[3]))
+		return
+	}
 
 	// env var and arguments
 	thisGitRepo = os.Getenv("GIT_DIR")
@@ -89,6 +135,8 @@ func main() {
 		cwd, err := os.Getwd()
 		logging.CheckFatal(err)
 		thisGitRepo = filepath.Join(cwd, ".git")
+		// the git commands we run have their Dir set to the repo, a relative GIT_DIR would point below it
+		check(os.Setenv("GIT_DIR", thisGitRepo))
 	}
 
 	var u string // repo url
@@ -101,16 +149,31 @@ func main() {
 		logFatal(fmt.Sprintf("usage: unknown # of args: %d\n%v", v, os.Args[1:]))
 	}
 
-	// parse passed URL
-	for _, pref := range []string{"ipfs://ipfs/", "ipfs:///ipfs/"} {
-		if strings.HasPrefix(u, pref) {
-			u = "/ipfs/" + u[len(pref):]
-		}
+	var err error
+	if strings.HasPrefix(u, "ipfs+car://") {
+		file, sub, err := parseCARURL(u)
+		check(err)
+		car, err := newCARStore(file)
+		check(err)
+		backend = car
+		u = strings.TrimSuffix("/ipfs/"+car.root+"/"+sub, "/")
+	} else {
+		backend, err = newBackend()
+		check(err)
 	}
-	p, err := path.ParsePath(u)
+
+	// parse passed URL
+	p, err := path.ParsePath(urlPath(u))
 	check(err)
 
 	ipfsRepoPath = p.String()
+	if strings.HasPrefix(ipfsRepoPath, "/ipns/") {
+		ipnsRemote = parseIPNS(ipfsRepoPath)
+		ipnsRemote.root, err = ipnsRemote.resolve()
+		check(err)
+		ipfsRepoPath = ipnsRemote.repoPath()
+		log.Log("name", ipnsRemote.name, "path", ipfsRepoPath, "event", "debug", "msg", "resolved")
+	}
 
 	// interrupt / error handling
 	go func() {
@@ -120,6 +183,16 @@ func main() {
 	check(speakGit(os.Stdin, os.Stdout))
 }
 
+// urlPath turns ipfs:// urls into /ipfs/ and /ipns/ paths
+func urlPath(u string) string {
+	for _, pref := range []string{"ipfs://ipfs/", "ipfs:///ipfs/", "ipfs://ipns/", "ipfs:///ipns/"} {
+		if strings.HasPrefix(u, pref) {
+			return "/" + strings.TrimLeft(u[len("ipfs:"):], "/")
+		}
+	}
+	return u
+}
+
 // speakGit acts like a git-remote-helper
 // see this for more: https://www.kernel.org/pub/software/scm/git/docs/gitremote-helpers.html
 func speakGit(r io.Reader, w io.Writer) error {
@@ -134,6 +207,7 @@ func speakGit(r io.Reader, w io.Writer) error {
 		case text == "capabilities":
 			fmt.Fprintln(w, "fetch")
 			fmt.Fprintln(w, "push")
+			fmt.Fprintln(w, "option")
 			fmt.Fprintln(w, "")
 
 		case strings.HasPrefix(text, "list"):
@@ -147,15 +221,16 @@ func speakGit(r io.Reader, w io.Writer) error {
 					return err
 				}
 			} else { // alternativly iterate over the refs directory like git-remote-dropbox
-				if forPush {
-					log.Log("msg", "for-push: should be able to push to non existant.. TODO #2")
-				}
 				log.Log("err", err, "msg", "didn't find info/refs in repo, falling back...")
 				if err = listIterateRefs(forPush); err != nil {
-					return err
+					// pushing to an empty directory or a new path creates the repo
+					if !forPush || !ipfsIsNotExist(err) {
+						return err
+					}
+					log.Log("msg", "no refs directory, pushing to a new repo")
 				}
 			}
-			if len(ref2hash) == 0 {
+			if len(ref2hash) == 0 && !forPush {
 				return errors.New("did not find _any_ refs...")
 			}
 			// output
@@ -166,63 +241,62 @@ func speakGit(r io.Reader, w io.Writer) error {
 				}
 				fmt.Fprintf(w, "%s %s\n", hash, ref)
 			}
-			fmt.Fprintf(w, "%s HEAD\n", head)
+			if head != "" {
+				fmt.Fprintf(w, "%s HEAD\n", head)
+			}
 			fmt.Fprintln(w)
 
 		case strings.HasPrefix(text, "fetch "):
-			for scanner.Scan() {
+			// collect the whole batch first so that objects shared between refs are only fetched once
+			var wants []string
+			for text != "" {
 				fetchSplit := strings.Split(text, " ")
 				if len(fetchSplit) < 2 {
 					return errors.Errorf("malformed 'fetch' command. %q", text)
 				}
-				err := fetchObject(fetchSplit[1])
-				if err == nil {
-					fmt.Fprintln(w)
-					continue
-				}
-				// TODO isNotExist(err) would be nice here
-				//log.Log("sha1", fetchSplit[1], "name", fetchSplit[2], "err", err, "msg", "fetchLooseObject failed, trying packed...")
-
-				err = fetchPackedObject(fetchSplit[1])
-				if err != nil {
-					return errors.Wrap(err, "fetchPackedObject() failed")
-				}
-				text = scanner.Text()
-				if text == "" {
+				wants = append(wants, fetchSplit[1])
+				if !scanner.Scan() {
 					break
 				}
+				text = scanner.Text()
+			}
+			connected, err := fetchBatch(wants)
+			if err != nil {
+				return err
+			}
+			if options.checkConnectivity && connected {
+				fmt.Fprintln(w, "connectivity-ok")
 			}
 			fmt.Fprintln(w, "")
 
-		case strings.HasPrefix(text, "push"):
-			for scanner.Scan() {
+		case strings.HasPrefix(text, "option "):
+			nameValue := strings.SplitN(strings.TrimPrefix(text, "option "), " ", 2)
+			if len(nameValue) != 2 {
+				return errors.Errorf("malformed 'option' command. %q", text)
+			}
+			fmt.Fprintln(w, setOption(nameValue[0], nameValue[1]))
+
+		case strings.HasPrefix(text, "push "):
+			// collect the whole batch, all refs are updated with a single new root
+			var refs []*pushRef
+			for text != "" {
 				pushSplit := strings.Split(text, " ")
 				if len(pushSplit) < 2 {
 					return errors.Errorf("malformed 'push' command. %q", text)
 				}
-				srcDstSplit := strings.Split(pushSplit[1], ":")
-				if len(srcDstSplit) < 2 {
-					return errors.Errorf("malformed 'push' command. %q", text)
-				}
-				src, dst := srcDstSplit[0], srcDstSplit[1]
-				f := []interface{}{
-					"src", src,
-					"dst", dst,
-				}
-				log.Log(append(f, "msg", "got push"))
-				if src == "" {
-					fmt.Fprintf(w, "error %s %s\n", dst, "delete remote dst: not supported yet - please open an issue on github")
-				} else {
-					if err := push(src, dst); err != nil {
-						fmt.Fprintf(w, "error %s %s\n", dst, err)
-						return err
-					}
-					fmt.Fprintln(w, "ok", dst)
+				ref, err := parsePushRef(pushSplit[1])
+				if err != nil {
+					return errors.Wrapf(err, "malformed 'push' command. %q", text)
 				}
-				text = scanner.Text()
-				if text == "" {
+				log.Log("src", ref.src, "dst", ref.dst, "force", ref.force, "msg", "got push")
+				refs = append(refs, ref)
+				if !scanner.Scan() {
 					break
 				}
+				text = scanner.Text()
+			}
+			if err := pushBatch(w, refs); err != nil {
+				return err
 			}
 			fmt.Fprintln(w, "")
 
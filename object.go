@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gitObject is a decoded loose object.
+// The content of blobs is not kept since nothing links out of them.
+type gitObject struct {
+	Type string // blob, tree, commit or tag
+	Size int64
+	Data []byte
+}
+
+// tree entry modes that need special treatment while walking
+const (
+	modeTree    = "40000"
+	modeGitlink = "160000"
+)
+
+type treeEntry struct {
+	Mode, Name string
+	SHA1       string
+}
+
+// decodeObject reads a zlib compressed loose object from r.
+// r is always read until EOF, even for blobs whose content is discarded.
+func decodeObject(r io.Reader) (*gitObject, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "zlib newReader failed")
+	}
+	br := bufio.NewReader(zr)
+	header, err := br.ReadString(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding header 0byte")
+	}
+	obj, err := parseObjectHeader(header[:len(header)-1])
+	if err != nil {
+		return nil, err
+	}
+	if obj.Type == "blob" {
+		if _, err := io.Copy(ioutil.Discard, br); err != nil {
+			return nil, errors.Wrap(err, "draining blob failed")
+		}
+	} else {
+		obj.Data, err = ioutil.ReadAll(io.LimitReader(br, obj.Size))
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s body failed", obj.Type)
+		}
+		if int64(len(obj.Data)) != obj.Size {
+			return nil, errors.Errorf("short %s body: %d of %d bytes", obj.Type, len(obj.Data), obj.Size)
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, errors.Wrap(err, "draining object reader failed")
+	}
+	return obj, zr.Close()
+}
+
+func parseObjectHeader(header string) (*gitObject, error) {
+	typeSize := strings.SplitN(header, " ", 2)
+	if len(typeSize) != 2 {
+		return nil, errors.Errorf("illegal git object header: %q", header)
+	}
+	switch typeSize[0] {
+	case "blob", "tree", "commit", "tag":
+	default:
+		return nil, errors.Errorf("illegal git object type: %q", header)
+	}
+	size, err := strconv.ParseInt(typeSize[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing header length: %q", header)
+	}
+	return &gitObject{Type: typeSize[0], Size: size}, nil
+}
+
+// links returns the sha1 of every object o points to that is needed for a complete repository:
+// tree and parents of commits, all entries of trees except gitlinks (submodule commits live in another repo)
+// and the tagged object of annotated tags.
+func (o *gitObject) links() ([]string, error) {
+	switch o.Type {
+	case "blob":
+		return nil, nil
+	case "commit":
+		lines := headerLines(o.Data)
+		if len(lines) == 0 || !strings.HasPrefix(lines[0], "tree ") {
+			return nil, errors.New("commit without tree")
+		}
+		links := []string{lines[0][5:]}
+		for _, line := range lines[1:] {
+			if strings.HasPrefix(line, "parent ") {
+				links = append(links, line[7:])
+			}
+		}
+		for _, l := range links {
+			if !isSha1(l) {
+				return nil, errors.Errorf("illegal link %q in commit", l)
+			}
+		}
+		return links, nil
+	case "tag":
+		for _, line := range headerLines(o.Data) {
+			if strings.HasPrefix(line, "object ") {
+				if !isSha1(line[7:]) {
+					return nil, errors.Errorf("illegal link %q in tag", line[7:])
+				}
+				return []string{line[7:]}, nil
+			}
+		}
+		return nil, errors.New("tag without object")
+	case "tree":
+		entries, err := o.treeEntries()
+		if err != nil {
+			return nil, err
+		}
+		var links []string
+		for _, e := range entries {
+			if e.Mode == modeGitlink {
+				continue
+			}
+			links = append(links, e.SHA1)
+		}
+		return links, nil
+	}
+	return nil, errors.Errorf("unhandled object type: %q", o.Type)
+}
+
+// isSha1 reports whether s is a full sha1 in lowercase hex, like git writes them into objects.
+// sha1s from the remote become paths, anything else must not get that far.
+func isSha1(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// headerLines returns the header part of commits and tags, up to the first empty line.
+// continuation lines (like the ones of gpgsig) are dropped.
+func headerLines(data []byte) []string {
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, len(data)+1)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (o *gitObject) treeEntries() ([]treeEntry, error) {
+	if o.Type != "tree" {
+		return nil, errors.Errorf("not a tree: %s", o.Type)
+	}
+	var (
+		entries []treeEntry
+		data    = o.Data
+	)
+	for len(data) > 0 {
+		nul := bytes.IndexByte(data, 0)
+		if nul == -1 || len(data) < nul+21 {
+			return nil, errors.Errorf("truncated tree entry after %d entries", len(entries))
+		}
+		modeName := strings.SplitN(string(data[:nul]), " ", 2)
+		if len(modeName) != 2 {
+			return nil, errors.Errorf("illegal tree entry: %q", data[:nul])
+		}
+		entries = append(entries, treeEntry{
+			Mode: modeName[0],
+			Name: modeName[1],
+			SHA1: hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+// tempLooseObject creates a temporary file next to the final location of the loose object sha1.
+// Writing to it first makes sure that an aborted fetch doesn't leave a broken object behind,
+// which would be taken as present by the next fetch.
+func tempLooseObject(sha1 string) (*os.File, string, error) {
+	target := filepath.Join(thisGitRepo, "objects", sha1[:2], sha1[2:])
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return nil, "", errors.Wrapf(err, "mkDirAll() failed")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "tmp_obj_")
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "tempFile(%s) failed", target)
+	}
+	return tmp, target, nil
+}
+
+// placeLooseObject closes the completely written tmp and moves it to target
+func placeLooseObject(tmp *os.File, target string) error {
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "target file close() failed")
+	}
+	// loose objects are read-only, like git writes them
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return errors.Wrapf(err, "chmod(%s) failed", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return errors.Wrapf(err, "rename(%s) failed", target)
+	}
+	return nil
+}
+
+// writeLooseObject stores data as a loose object of the given kind in the local repo and returns its sha1
+func writeLooseObject(kind string, data []byte) (string, error) {
+	header := fmt.Sprintf("%s %d\x00", kind, len(data))
+	h := sha1.New()
+	io.WriteString(h, header)
+	h.Write(data)
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	tmp, target, err := tempLooseObject(sum)
+	if err != nil {
+		return "", err
+	}
+	zw := zlib.NewWriter(tmp)
+	io.WriteString(zw, header)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", errors.Wrapf(err, "writing loose object %s failed", sum)
+	}
+	return sum, placeLooseObject(tmp, target)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func looseObject(t *testing.T, kind string, body []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	fmt.Fprintf(zw, "%s %d\x00", kind, len(body))
+	zw.Write(body)
+	checkFatal(t, zw.Close())
+	return buf.Bytes()
+}
+
+func treeEntryBytes(t *testing.T, mode, name, sha1 string) []byte {
+	raw, err := hex.DecodeString(sha1)
+	checkFatal(t, err)
+	return append([]byte(mode+" "+name+"\x00"), raw...)
+}
+
+func TestObjectLinks(t *testing.T) {
+	const (
+		tree    = "9bedf67800b2923982bdf60c89c57ce6ce2d9a1c"
+		parentA = "2b8f8c5ec2f6b5ef9fdb2c2b59f03adbd85a3d59"
+		parentB = "a58e8fbd6f15f6fa7e3f7e5b08c2da4f32d07f69"
+		subTree = "e2839ad2e47386d342038958fba941fc78e3780e"
+		blob    = "32ed91604b272860ec911fc2bf4ae631b7900aa8"
+		gitlink = "9417d011822b875da72221c8d188089cbfcee806"
+	)
+
+	var treeBody []byte
+	treeBody = append(treeBody, treeEntryBytes(t, "100644", "hello.txt", blob)...)
+	treeBody = append(treeBody, treeEntryBytes(t, modeTree, "sub", subTree)...)
+	treeBody = append(treeBody, treeEntryBytes(t, modeGitlink, "vendor", gitlink)...)
+
+	cases := []struct {
+		kind string
+		body []byte
+		want []string
+	}{
+		{"blob", []byte("hello\n"), nil},
+		{"tree", treeBody, []string{blob, subTree}},
+		{"commit", []byte("tree " + tree + "\n" +
+			"parent " + parentA + "\n" +
+			"parent " + parentB + "\n" +
+			"author A U Thor <a@example.com> 1438988455 +0200\n" +
+			"committer A U Thor <a@example.com> 1438988455 +0200\n" +
+			"gpgsig -----BEGIN PGP SIGNATURE-----\n" +
+			" parent 0000000000000000000000000000000000000000\n" +
+			" -----END PGP SIGNATURE-----\n" +
+			"\n" +
+			"Merge\n\nparent " + gitlink + "\n"),
+			[]string{tree, parentA, parentB}},
+		{"tag", []byte("object " + parentA + "\ntype commit\ntag v1.0\n\nrelease\n"), []string{parentA}},
+	}
+	for _, tc := range cases {
+		obj, err := decodeObject(bytes.NewReader(looseObject(t, tc.kind, tc.body)))
+		checkFatal(t, err)
+		if obj.Type != tc.kind || obj.Size != int64(len(tc.body)) {
+			t.Fatalf("%s: wrong header: %s %d", tc.kind, obj.Type, obj.Size)
+		}
+		got, err := obj.links()
+		checkFatal(t, err)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: wrong links\nWant: %v\nGot:  %v", tc.kind, tc.want, got)
+		}
+	}
+}
+
+func TestDecodeObject_broken(t *testing.T) {
+	for _, data := range [][]byte{
+		looseObject(t, "blub", []byte("x")),
+		looseObject(t, "tree", nil)[:8],
+		[]byte("not zlib"),
+	} {
+		if _, err := decodeObject(bytes.NewReader(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+	obj, err := decodeObject(bytes.NewReader(looseObject(t, "tree", []byte("100644 truncated\x00abc"))))
+	checkFatal(t, err)
+	if _, err := obj.links(); err == nil {
+		t.Error("expected error for truncated tree entry")
+	}
+	const tree = "9bedf67800b2923982bdf60c89c57ce6ce2d9a1c"
+	for _, tc := range []struct{ kind, body string }{
+		{"commit", "author A U Thor <a@example.com> 1438988455 +0200\ntree " + tree + "\n\n"},
+		{"commit", "tree ../../../config\n\n"},
+		{"commit", "tree " + tree + "\nparent 2B8F\n\n"},
+		{"tag", "object ab/../../" + tree + "\ntype commit\n\n"},
+	} {
+		obj, err := decodeObject(bytes.NewReader(looseObject(t, tc.kind, []byte(tc.body))))
+		checkFatal(t, err)
+		if _, err := obj.links(); err == nil {
+			t.Errorf("expected error for %s %q", tc.kind, tc.body)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cryptix/go/logging"
+)
+
+// helperOptions are set by git with 'option <name> <value>' before fetch and push
+type helperOptions struct {
+	verbosity         int  // 0 is quiet, 1 the default, more is for debugging
+	progress          bool // show progress on stderr
+	dryRun            bool // push: report what would happen without changing the remote
+	followTags        bool // fetch: also fetch tags pointing into the fetched history
+	depth             int  // fetch: only this many commits of history, 0 for all of it
+	checkConnectivity bool // fetch: tell git that everything reachable from the fetched refs is there
+	force             bool // push: force all refs
+	cloning           bool // fetch: into an empty repo
+	atomic            bool // push: update all refs or none
+	// push: the values refs must still have on the remote, --force-with-lease.
+	// An empty value means the ref must not exist.
+	cas map[string]string
+}
+
+var options = helperOptions{verbosity: 1}
+
+// setOption applies an option command and returns the answer for git: ok, unsupported or an error
+func setOption(name, value string) string {
+	ints := map[string]*int{
+		"verbosity": &options.verbosity,
+		"depth":     &options.depth,
+	}
+	bools := map[string]*bool{
+		"progress":           &options.progress,
+		"dry-run":            &options.dryRun,
+		"followtags":         &options.followTags,
+		"check-connectivity": &options.checkConnectivity,
+		"force":              &options.force,
+		"cloning":            &options.cloning,
+		"atomic":             &options.atomic,
+	}
+	if name == "cas" {
+		return setCAS(value)
+	}
+	if p, ok := ints[name]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "error " + err.Error()
+		}
+		if n < 0 {
+			return fmt.Sprintf("error negative %s %d", name, n)
+		}
+		*p = n
+		return "ok"
+	}
+	if p, ok := bools[name]; ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "error " + err.Error()
+		}
+		*p = b
+		return "ok"
+	}
+	return "unsupported"
+}
+
+// setCAS adds the '<ref>:<sha1>' of a cas option, quoted by git if needed
+func setCAS(value string) string {
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "error " + err.Error()
+		}
+		value = unquoted
+	}
+	i := strings.LastIndex(value, ":")
+	if i < 1 {
+		return fmt.Sprintf("error malformed cas %q", value)
+	}
+	ref, sha1 := value[:i], value[i+1:]
+	if len(sha1) != 40 || strings.Trim(sha1, "0123456789abcdef") != "" {
+		return fmt.Sprintf("error malformed cas %q", value)
+	}
+	if strings.Trim(sha1, "0") == "" {
+		// the null sha1: the ref must not exist yet
+		sha1 = ""
+	}
+	if options.cas == nil {
+		options.cas = make(map[string]string)
+	}
+	options.cas[ref] = sha1
+	return "ok"
+}
+
+// verbosityLogger drops debug events unless git asked for more output
+// and everything but errors when asked to be quiet
+type verbosityLogger struct {
+	next logging.Interface
+}
+
+func (l verbosityLogger) Log(keyvals ...interface{}) error {
+	var isErr, isDebug bool
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case "err":
+			isErr = keyvals[i+1] != nil
+		case "event":
+			isDebug = keyvals[i+1] == "debug"
+		}
+	}
+	switch {
+	case options.verbosity >= 2:
+	case options.verbosity == 0 && !isErr:
+		return nil
+	case isDebug:
+		return nil
+	}
+	return l.next.Log(keyvals...)
+}
+
+// progressf overwrites the progress line on stderr if git asked for progress.
+// The last call for a task passes done to end the line.
+func progressf(done bool, format string, args ...interface{}) {
+	if !options.progress {
+		return
+	}
+	end := ""
+	if done {
+		end = ", done.\n"
+	}
+	fmt.Fprintf(os.Stderr, "\r"+format+end, args...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetOption(t *testing.T) {
+	defer func(old helperOptions) { options = old }(options)
+
+	for _, tc := range []struct {
+		name, value, want string
+	}{
+		{"verbosity", "2", "ok"},
+		{"progress", "true", "ok"},
+		{"dry-run", "true", "ok"},
+		{"followtags", "true", "ok"},
+		{"depth", "3", "ok"},
+		{"check-connectivity", "true", "ok"},
+		{"force", "true", "ok"},
+		{"cloning", "true", "ok"},
+		{"atomic", "true", "ok"},
+		{"depth", "-1", "error negative depth -1"},
+		{"dry-run", "maybe", `error strconv.ParseBool: parsing "maybe": invalid syntax`},
+		{"cas", "refs/heads/master:0123456789abcdef0123456789abcdef01234567", "ok"},
+		{"cas", `"refs/heads/t\303\244st:0000000000000000000000000000000000000000"`, "ok"},
+		{"cas", "refs/heads/master", `error malformed cas "refs/heads/master"`},
+		{"cas", "refs/heads/master:HEAD", `error malformed cas "refs/heads/master:HEAD"`},
+		{"push-option", "x", "unsupported"},
+	} {
+		if got := setOption(tc.name, tc.value); got != tc.want {
+			t.Errorf("option %s %s: got %q, want %q", tc.name, tc.value, got, tc.want)
+		}
+	}
+	want := helperOptions{
+		verbosity:         2,
+		progress:          true,
+		dryRun:            true,
+		followTags:        true,
+		depth:             3,
+		checkConnectivity: true,
+		force:             true,
+		cloning:           true,
+		atomic:            true,
+		cas: map[string]string{
+			"refs/heads/master": "0123456789abcdef0123456789abcdef01234567",
+			"refs/heads/täst":   "",
+		},
+	}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("wrong options\nWant: %+v\nGot:  %+v", want, options)
+	}
+}
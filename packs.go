@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cryptix/git-remote-ipfs/internal/pack"
+	"github.com/pkg/errors"
+)
+
+// remotePack is a pack file of the remote repo together with its parsed index
+type remotePack struct {
+	path  string // of the .pack file
+	index *pack.Index
+
+	mu       sync.Mutex
+	bases    map[uint64]packedObject // recently resolved delta bases, by offset
+	imported bool                    // the whole pack was fetched by fetchPackedObject
+}
+
+type packedObject struct {
+	kind string
+	data []byte
+}
+
+// remotePacks loads the packs of the remote repo on first use
+// and answers which pack has an object from memory after that
+type remotePacks struct {
+	once  sync.Once
+	packs []*remotePack
+	err   error
+}
+
+// sessionPacks is shared by all fetch commands of this invocation,
+// so the pack listing and index files are only downloaded once
+var sessionPacks = new(remotePacks)
+
+// find returns the pack which has sha1 or nil if none has it
+func (rp *remotePacks) find(sha1 string) (*remotePack, error) {
+	rp.once.Do(func() {
+		rp.packs, rp.err = loadRemotePacks()
+	})
+	if rp.err != nil {
+		return nil, rp.err
+	}
+	for _, p := range rp.packs {
+		if p.index.Contains(sha1) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// loadRemotePacks lists objects/pack of the remote repo and reads all index files in it
+func loadRemotePacks() ([]*remotePack, error) {
+	packPath := filepath.Join(ipfsRepoPath, "objects", "pack")
+	links, err := backend.List(packPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "shell FileList(%q) failed", packPath)
+	}
+	var (
+		packs    []*remotePack
+		cacheDir = idxCacheDir()
+	)
+	for _, lnk := range links {
+		if lnk.Type != 2 || !strings.HasSuffix(lnk.Name, ".idx") {
+			continue
+		}
+		idx := filepath.Join(packPath, lnk.Name)
+		packIdx, err := readRemoteIndex(idx, lnk.Hash, cacheDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loadRemotePacks: reading %s failed", idx)
+		}
+		packs = append(packs, &remotePack{
+			path:  strings.TrimSuffix(idx, ".idx") + ".pack",
+			index: packIdx,
+			bases: make(map[uint64]packedObject),
+		})
+	}
+	log.Log("packs", len(packs), "event", "debug", "msg", "loaded remote pack indexes")
+	return packs, nil
+}
+
+// readRemoteIndex returns the parsed index file at p, using the index cache in cacheDir if it isn't empty.
+// Since they are keyed by CID, cached indexes are shared between all repos.
+// A cached index isn't hashed against its CID again, the checksum of the index has to do: the cache is as private
+// as the repo and objects found with an index are checked by git or writeLooseObject anyway.
+// A wrong index can only make a fetch fail, not bring in wrong objects.
+func readRemoteIndex(p, cid, cacheDir string) (*pack.Index, error) {
+	if cacheDir == "" || cid == "" {
+		return catRemoteIndex(p, "")
+	}
+	cached := filepath.Join(cacheDir, cid+".idx")
+	f, err := os.Open(cached)
+	if err == nil {
+		packIdx, err := pack.ReadIndex(f)
+		f.Close()
+		if err == nil {
+			return packIdx, nil
+		}
+		log.Log("err", err, "cached", cached, "msg", "broken cached index - fetching it again")
+	}
+	return catRemoteIndex(p, cached)
+}
+
+// catRemoteIndex downloads the index file at p and stores it at cached, unless that is empty
+func catRemoteIndex(p, cached string) (*pack.Index, error) {
+	idxF, err := backend.Cat(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cat(%s) failed", p)
+	}
+	data, err := ioutil.ReadAll(idxF)
+	idxF.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s failed", p)
+	}
+	packIdx, err := pack.ReadIndex(bytes.NewReader(data))
+	if err != nil || cached == "" {
+		return packIdx, err
+	}
+	if err := writeFileAtomic(cached, data); err != nil {
+		// not being able to cache shouldn't stop the fetch
+		log.Log("err", err, "cached", cached, "msg", "caching index failed")
+	}
+	return packIdx, nil
+}
+
+// idxCacheDir returns where downloaded index files are kept.
+// It is empty unless caching is turned on with 'git config ipfs.idxCache true'.
+func idxCacheDir() string {
+	cache, err := gitConfigBool("ipfs.idxCache", false)
+	if err != nil {
+		log.Log("err", err, "msg", "reading ipfs.idxCache failed - not caching indexes")
+	}
+	if !cache {
+		return ""
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "git-remote-ipfs", "idx")
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return errors.Wrap(err, "mkDirAll() failed")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "tmp_")
+	if err != nil {
+		return errors.Wrap(err, "tempFile() failed")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "write failed")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "close failed")
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// missingLinks returns the objects that objects of p link to but which aren't in the local repo.
+// Only useful after p was imported, to find the loose objects of the remote it builds upon.
+func (p *remotePack) missingLinks() ([]string, error) {
+	// blobs don't link anywhere, only the others are read
+	var linking []string
+	err := gitCatBatchCheck(p.index.Objects(), func(sha1, kind string) error {
+		if kind != "blob" {
+			linking = append(linking, sha1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	err = gitCatBatch(linking, func(sha1, kind string, data []byte) error {
+		obj := &gitObject{Type: kind, Size: int64(len(data)), Data: data}
+		links, err := obj.links()
+		if err != nil {
+			return errors.Wrapf(err, "sha1<%s> broken %s object", sha1, kind)
+		}
+		for _, l := range links {
+			if p.index.Contains(l) {
+				continue
+			}
+			has, err := gitHasObject(l)
+			if err != nil {
+				return errors.Wrapf(err, "gitHasObject(%s) failed", l)
+			}
+			if !has {
+				missing = append(missing, l)
+			}
+		}
+		return nil
+	})
+	return missing, err
+}
+
+// deltas chains are limited to 50 by git's default, this is just to stop on broken packs
+const maxDeltaDepth = 1000
+
+// readObject reconstructs sha1 by reading only its own byte range of the pack and the ones of its delta bases
+func (p *remotePack) readObject(sha1 string) (string, []byte, error) {
+	offset, ok := p.index.Offset(sha1)
+	if !ok {
+		return "", nil, errors.Errorf("sha1<%s> not in %s", sha1, p.path)
+	}
+	return p.readAt(offset, 0)
+}
+
+func (p *remotePack) readAt(offset uint64, depth int) (string, []byte, error) {
+	if depth > maxDeltaDepth {
+		return "", nil, errors.Errorf("delta chain in %s too long at %d", p.path, offset)
+	}
+	if depth > 0 {
+		p.mu.Lock()
+		base, ok := p.bases[offset]
+		p.mu.Unlock()
+		if ok {
+			return base.kind, base.data, nil
+		}
+	}
+
+	length := int64(-1) // the last entry is followed by the pack checksum, zlib knows where to stop
+	if end, ok := p.index.EntryEnd(offset); ok {
+		length = int64(end - offset)
+	}
+	rc, err := backend.CatRange(p.path, int64(offset), length)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "cat range %d+%d of %s failed", offset, length, p.path)
+	}
+	hdr, data, err := pack.ReadEntry(rc)
+	rc.Close()
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading entry at %d of %s failed", offset, p.path)
+	}
+
+	var kind string
+	switch hdr.Type {
+	case pack.OfsDelta:
+		if hdr.BaseOffset == 0 || hdr.BaseOffset > offset {
+			return "", nil, errors.Errorf("illegal base offset %d at %d of %s", hdr.BaseOffset, offset, p.path)
+		}
+		var base []byte
+		kind, base, err = p.readAt(offset-hdr.BaseOffset, depth+1)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err = pack.ApplyDelta(base, data)
+	case pack.RefDelta:
+		var base []byte
+		if baseOffset, ok := p.index.Offset(hdr.BaseRef); ok {
+			kind, base, err = p.readAt(baseOffset, depth+1)
+		} else {
+			// thin packs reference objects we should already have
+			kind, base, err = gitCatObject(hdr.BaseRef)
+		}
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "delta base %s", hdr.BaseRef)
+		}
+		data, err = pack.ApplyDelta(base, data)
+	default:
+		kind = hdr.Type.String()
+	}
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "applying delta at %d of %s failed", offset, p.path)
+	}
+
+	if depth > 0 && len(data) < maxCachedBaseSize {
+		p.mu.Lock()
+		if len(p.bases) >= maxCachedBases {
+			p.bases = make(map[uint64]packedObject)
+		}
+		p.bases[offset] = packedObject{kind, data}
+		p.mu.Unlock()
+	}
+	return kind, data, nil
+}
+
+// objects sharing a delta base are often fetched together, so we keep some bases around
+const (
+	maxCachedBases    = 256
+	maxCachedBaseSize = 1 << 20
+)
+
+// fetchRangeObject reads sha1 out of the remote pack that has it and stores it as a loose object
+func fetchRangeObject(packs *remotePacks, sha1 string) (*gitObject, error) {
+	p, err := packs.find(sha1)
+	if err != nil {
+		return nil, errors.Wrap(err, "finding pack failed")
+	}
+	if p == nil {
+		return nil, errors.Errorf("sha1<%s> is neither a loose object nor in any pack", sha1)
+	}
+	kind, data, err := p.readObject(sha1)
+	if err != nil {
+		return nil, err
+	}
+	written, err := writeLooseObject(kind, data)
+	if err != nil {
+		return nil, err
+	}
+	if written != sha1 {
+		return nil, errors.Errorf("object from %s hashes to %s, expected %s", p.path, written, sha1)
+	}
+	obj := &gitObject{Type: kind, Size: int64(len(data))}
+	if kind != "blob" {
+		obj.Data = data
+	}
+	return obj, nil
+}
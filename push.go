@@ -1,37 +1,403 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
-func push(src, dst string) error {
-	var force = strings.HasPrefix(src, "+")
-	if force {
-		src = src[1:]
+// pushRef is one line of a push batch: update dst to src, or delete dst if src is empty
+type pushRef struct {
+	src, dst string
+	force    bool
+	sha1     string // of src
+	update   string // what happens to dst: created, fast-forward, forced or deleted
+	err      error  // why the ref isn't updated, reported to git
+}
+
+func (r *pushRef) isDelete() bool { return r.src == "" }
+
+// parsePushRef parses the '[+]<src>:<dst>' of a push command
+func parsePushRef(spec string) (*pushRef, error) {
+	srcDst := strings.Split(spec, ":")
+	if len(srcDst) != 2 {
+		return nil, errors.Errorf("malformed refspec %q", spec)
+	}
+	r := &pushRef{src: srcDst[0], dst: srcDst[1]}
+	if strings.HasPrefix(r.src, "+") {
+		r.force, r.src = true, r.src[1:]
+	}
+	return r, nil
+}
+
+// pushBatch updates all refs of a push batch with a single new root and writes the status of every ref to w.
+// Rejected refs get an error line while the others are updated, unless the push is atomic.
+// The remote url is only changed once everything is written.
+func pushBatch(w io.Writer, refs []*pushRef) error {
+	err := pushRefs(refs)
+	for try := 0; err == nil && nameMoved(refs) && try < maxIPNSRebases && ipnsRebase(); try++ {
+		rebased, rebaseErr := ipnsRemote.rebase(refs)
+		if rebaseErr != nil {
+			log.Log("err", rebaseErr, "msg", "rebasing on the republished name failed")
+			break
+		}
+		if !rebased {
+			break
+		}
+		for _, r := range refs {
+			r.update, r.err = "", nil
+		}
+		err = pushRefs(refs)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, r := range refs {
+		if r.err != nil {
+			// the reason must fit on the status line
+			fmt.Fprintf(w, "error %s %s\n", r.dst, strings.Join(strings.Fields(r.err.Error()), " "))
+			continue
+		}
+		fmt.Fprintln(w, "ok", r.dst)
+	}
+	return nil
+}
+
+// pushRefs sets the error of every ref that isn't updated by the push
+func pushRefs(refs []*pushRef) error {
+	root, err := backend.ResolvePath(ipfsRepoPath)
+	if ipfsIsNotExist(err) {
+		log.Log("path", ipfsRepoPath, "msg", "creating new repo")
+		root, err = "", nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "resolvePath(%s) failed", ipfsRepoPath)
+	}
+	patch := newRootPatch(root)
+	if err := checkPushRefs(patch, refs); err != nil {
+		return err
+	}
+
+	var accepted []*pushRef
+	for _, r := range refs {
+		if r.err == nil {
+			accepted = append(accepted, r)
+		}
+	}
+	if len(accepted) < len(refs) && options.atomic {
+		for _, r := range accepted {
+			r.err = errors.New("atomic push failed")
+		}
+		accepted = nil
+	}
+	if len(accepted) > 0 {
+		if err := updateRefs(patch, accepted); err != nil {
+			// nothing was published, none of them is updated
+			log.Log("err", err, "msg", "push failed")
+			for _, r := range accepted {
+				r.err = err
+			}
+		}
+	}
+	return nil
+}
+
+// checkPushRefs sets the error of every ref that can't be updated
+func checkPushRefs(patch *rootPatch, refs []*pushRef) error {
+	headRef, err := remoteHead(patch)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		r.force = r.force || options.force
+		old, exists := ref2hash[r.dst]
+		if expected, ok := options.cas[r.dst]; ok {
+			// the listed refs can be outdated, the lease is checked against the root that is changed
+			actual, err := remoteRef(patch, r.dst)
+			if err != nil {
+				r.err = errors.Wrapf(err, "reading remote %s failed", r.dst)
+				continue
+			}
+			if actual != expected {
+				r.err = errors.New("stale info")
+				continue
+			}
+			// git sends the refspec of a lease without "+", it's forced once the remote is where it was expected
+			old, exists = actual, actual != ""
+			r.force = true
+		}
+		if r.isDelete() {
+			r.update = "deleted"
+			switch {
+			case !exists:
+				r.err = errors.New("remote ref does not exist")
+			case r.dst == headRef && !r.force && denyDeleteCurrent():
+				// HEAD is moved to another branch if allowed
+				r.err = errors.New("refusing to delete the current branch")
+			}
+			continue
+		}
+		if r.sha1, err = gitRefHash(r.src); err != nil {
+			r.err = errors.Wrapf(err, "gitRefHash(%s) failed", r.src)
+			continue
+		}
+		// a ref the remote doesn't have yet is created, there is nothing to fast-forward
+		if !exists {
+			r.update = "created"
+			continue
+		}
+		r.update, err = checkUpdate(r, old)
+		if err != nil {
+			r.update, r.err = "", err
+		}
+	}
+	return nil
+}
+
+// checkUpdate returns how the remote ref at old is updated to r.sha1,
+// or the reason to reject it in the words git knows from its own transports, so it can print its usual hints
+func checkUpdate(r *pushRef, old string) (string, error) {
+	if strings.HasPrefix(r.dst, "refs/tags/") {
+		if !r.force {
+			return "", errors.New("already exists")
+		}
+		return "forced", nil
+	}
+	has, err := gitHasObject(old)
+	if err != nil {
+		return "", err
+	}
+	if !has {
+		// someone else pushed something we don't know yet
+		if !r.force {
+			return "", errors.New("fetch first")
+		}
+		return "forced", nil
+	}
+	for _, sha1 := range []string{old, r.sha1} {
+		kind, err := gitCatKind(sha1)
+		if err != nil {
+			return "", errors.Wrapf(err, "gitCatKind(%s) failed", sha1)
+		}
+		if kind == "commit" {
+			continue
+		}
+		// only commits can be fast-forwarded
+		if !r.force {
+			return "", errors.New("needs force")
+		}
+		return "forced", nil
+	}
+	ff, err := gitIsAncestor(old, r.sha1)
+	switch {
+	case err != nil:
+		return "", err
+	case ff:
+		return "fast-forward", nil
+	case r.force:
+		return "forced", nil
+	}
+	return "", errors.New("non-fast-forward")
+}
+
+// updateRefs uploads the objects of all refs, writes them into one new root and points the remote to it
+func updateRefs(patch *rootPatch, refs []*pushRef) error {
+	present, err := remoteHaves()
+	if err != nil {
+		return errors.Wrap(err, "push: finding remote objects failed")
+	}
+	var (
+		srcs    []string
+		objects int
+	)
+	for _, r := range refs {
+		if !r.isDelete() {
+			srcs = append(srcs, r.sha1)
+		}
+	}
+	if len(ref2hash) == 0 {
+		// empty or new: the skeleton of a bare repo, the rest is filled in by the push
+		for _, dir := range []string{"objects/info", "objects/pack", "refs/heads", "refs/tags", "info"} {
+			patch.mkdir(dir)
+		}
+	}
+	if len(srcs) > 0 {
+		need2push, err := gitListObjects(srcs, present)
+		if err != nil {
+			return errors.Wrapf(err, "push: git list objects failed %v %v", srcs, present)
+		}
+		objects = len(need2push)
+		if len(need2push) > 0 {
+			if pushPacked() {
+				err = pushPack(patch, need2push)
+			} else {
+				err = pushLoose(patch, need2push)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// ref2hash is only changed once the new root exists
+	newRefs := make(map[string]string, len(ref2hash))
+	for ref, h := range ref2hash {
+		newRefs[ref] = h
+	}
+	for _, r := range refs {
+		delete(newRefs, r.dst+peeledSuffix)
+		if r.isDelete() {
+			patch.rmLink(r.dst)
+			delete(newRefs, r.dst)
+			if err := removePackedRef(patch, r.dst); err != nil {
+				return err
+			}
+			continue
+		}
+		mhash, size, err := backend.Add(strings.NewReader(r.sha1+"\n"), options.dryRun)
+		if err != nil {
+			return errors.Wrapf(err, "add(%s) failed", r.sha1)
+		}
+		patch.addLink(r.dst, mhash, size)
+		newRefs[r.dst] = r.sha1
+	}
+	if err := updateServerInfo(patch, newRefs); err != nil {
+		return errors.Wrap(err, "updating server info failed")
+	}
+	if options.dryRun {
+		// everything above was only hashed, nothing is stored
+		root, size, err := patch.dryApply()
+		if err != nil {
+			return errors.Wrapf(err, "hashing the new root of %s failed", ipfsRepoPath)
+		}
+		for _, r := range refs {
+			fmt.Fprintf(os.Stderr, "would update %s: %s %s..%s\n", r.dst, r.update, shortSha(ref2hash[r.dst]), shortSha(r.sha1))
+		}
+		if ipnsRemote != nil && ipnsRemote.sub != "" {
+			// the name points to a directory above the repo
+			published, err := ipnsRemote.linkRepo(root, size, hashDir)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "would publish %d objects as ipfs:///ipfs/%s at %s of /ipns/%s, republishing it as /ipfs/%s\n",
+				objects, root, ipnsRemote.sub, ipnsRemote.name, published)
+			return nil
+		}
+		if ipnsRemote != nil {
+			fmt.Fprintf(os.Stderr, "would publish %d objects as ipfs:///ipfs/%s under /ipns/%s\n", objects, root, ipnsRemote.name)
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "would publish %d objects as ipfs:///ipfs/%s\n", objects, root)
+		return nil
+	}
+	root, err := patch.apply()
+	if err != nil {
+		return errors.Wrapf(err, "patching %s failed", ipfsRepoPath)
+	}
+	for _, r := range refs {
+		log.Log("newRoot", root, "dst", r.dst, "hash", r.sha1, "update", r.update, "msg", "updated ref")
+	}
+	if ipnsRemote != nil {
+		err = ipnsRemote.publish(root)
+	} else {
+		err = updateRemoteURL(root)
+	}
+	if err != nil {
+		return err
+	}
+	ref2hash = newRefs
+	return nil
+}
+
+// updateRemoteURL points the remote to the new root
+func updateRemoteURL(root string) error {
+	ipfsRepoPath = "/ipfs/" + root
+	newRemoteURL := fmt.Sprintf("ipfs:///ipfs/%s", root)
+	updateRepoCMD := exec.Command("git", "remote", "set-url", thisGitRemote, newRemoteURL)
+	out, err := updateRepoCMD.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "updating remote url failed\nOut:%s", string(out))
+	}
+	log.Log("msg", "remote updated", "address", newRemoteURL)
+	return nil
+}
+
+// remoteHaves returns the objects of all known remote refs that are in the local repo.
+// Everything reachable from them doesn't need to be pushed again,
+// the others are skipped because rev-list can't exclude objects it doesn't know.
+func remoteHaves() ([]string, error) {
+	seen := make(map[string]bool)
+	var haves []string
+	for ref, h := range ref2hash {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		ok, err := gitHasObject(h)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Log("ref", ref, "sha1", h, "msg", "remote ref not in local repo")
+			continue
+		}
+		haves = append(haves, h)
 	}
-	var present []string
-	for _, h := range ref2hash {
-		present = append(present, h)
+	sort.Strings(haves)
+	return haves, nil
+}
+
+// shortSha abbreviates sha1 for messages, missing ones are shown as zeros like git does
+func shortSha(sha1 string) string {
+	if sha1 == "" {
+		return "0000000"
 	}
-	// also: track previously pushed branches in 2nd map and extend present with it
-	need2push, err := gitListObjects(src, present)
+	if len(sha1) < 7 {
+		return sha1
+	}
+	return sha1[:7]
+}
+
+// denyDeleteCurrent reports whether the branch HEAD points to can't be deleted.
+// git doesn't pass --force for deletions, so like receive.denyDeleteCurrent this is allowed with 'git config ipfs.denyDeleteCurrent false'
+func denyDeleteCurrent() bool {
+	deny, err := gitConfigBool("ipfs.denyDeleteCurrent", true)
 	if err != nil {
-		return errors.Wrapf(err, "push: git list objects failed %q %v", src, present)
+		log.Log("err", err, "msg", "reading ipfs.denyDeleteCurrent failed - denying")
 	}
+	return deny
+}
+
+// pushPacked reports whether objects are pushed as a single pack, configured with 'git config ipfs.pushPack true'
+func pushPacked() bool {
+	packed, err := gitConfigBool("ipfs.pushPack", false)
+	if err != nil {
+		log.Log("err", err, "msg", "reading ipfs.pushPack failed - pushing loose objects")
+	}
+	return packed
+}
+
+// pushLoose adds every object separately and links it to objects/xx/yyyy
+func pushLoose(patch *rootPatch, need2push []string) error {
 	n := len(need2push)
 	type pair struct {
 		Sha1  string
 		MHash string
+		Size  uint64
 		Err   error
 	}
 	added := make(chan pair)
-	objHash2multi := make(map[string]string, n)
 	for _, sha1 := range need2push {
 		go func(sha1 string) {
 			r, err := gitFlattenObject(sha1)
@@ -39,12 +405,12 @@ func push(src, dst string) error {
 				added <- pair{Err: errors.Wrapf(err, "gitFlattenObject failed")}
 				return
 			}
-			mhash, err := ipfsShell.Add(r)
+			mhash, size, err := backend.Add(r, options.dryRun)
 			if err != nil {
-				added <- pair{Err: errors.Wrapf(err, "shell.Add(%s) failed", sha1)}
+				added <- pair{Err: errors.Wrapf(err, "add(%s) failed", sha1)}
 				return
 			}
-			added <- pair{Sha1: sha1, MHash: mhash}
+			added <- pair{Sha1: sha1, MHash: mhash, Size: size}
 		}(sha1)
 	}
 	for n > 0 {
@@ -54,64 +420,246 @@ func push(src, dst string) error {
 			if p.Err != nil {
 				return p.Err
 			}
-			log.Log("sha1", p.Sha1, "mhash", p.MHash, "msg", "added")
-			objHash2multi[p.Sha1] = p.MHash
+			log.Log("sha1", p.Sha1, "mhash", p.MHash, "event", "debug", "msg", "added")
+			patch.addLink(path.Join("objects", p.Sha1[:2], p.Sha1[2:]), p.MHash, p.Size)
 			n--
+			progressf(false, "Writing objects: %d/%d", len(need2push)-n, len(need2push))
 		}
 	}
-	root, err := ipfsShell.ResolvePath(ipfsRepoPath)
+	progressf(true, "Writing objects: %d/%d", len(need2push), len(need2push))
+	return nil
+}
+
+// pushPack packs need2push into a single pack and links it together with its index under objects/pack
+func pushPack(patch *rootPatch, need2push []string) error {
+	tmpDir, err := ioutil.TempDir("", "git-remote-ipfs-push")
 	if err != nil {
-		return errors.Wrapf(err, "resolvePath(%s) failed", ipfsRepoPath)
+		return errors.Wrap(err, "pushPack: tempDir failed")
+	}
+	defer os.RemoveAll(tmpDir)
+	packSha, err := gitPackObjects(need2push, filepath.Join(tmpDir, "pack"))
+	if err != nil {
+		return errors.Wrap(err, "pushPack: packing objects failed")
+	}
+	name := "pack-" + packSha
+	for _, ext := range []string{".pack", ".idx"} {
+		f, err := os.Open(filepath.Join(tmpDir, name+ext))
+		if err != nil {
+			return errors.Wrapf(err, "pushPack: open %s failed", ext)
+		}
+		mhash, size, err := backend.Add(f, options.dryRun)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "pushPack: add(%s) failed", name+ext)
+		}
+		patch.addLink(path.Join("objects", "pack", name+ext), mhash, size)
+	}
+	log.Log("pack", name, "objects", len(need2push), "msg", "added pack")
+	return nil
+}
+
+// peeledSuffix marks the lines of info/refs that name the object a tag points to
+const peeledSuffix = "^{}"
+
+// updateServerInfo writes info/refs and objects/info/packs and makes sure HEAD points to a branch,
+// like git update-server-info does. list relies on info/refs, without it all refs need to be walked,
+// and dumb http clients (through a gateway) can't do without them at all.
+func updateServerInfo(patch *rootPatch, refs map[string]string) error {
+	if err := updateInfoRefs(patch, refs); err != nil {
+		return err
+	}
+	if err := updateHead(patch, refs); err != nil {
+		return err
 	}
-	for sha1, mhash := range objHash2multi {
-		newRoot, err := ipfsShell.PatchLink(root, filepath.Join("objects", sha1[:2], sha1[2:]), mhash, true)
+	return updateInfoPacks(patch)
+}
+
+// updateInfoRefs writes info/refs for refs, adding the peeled object of annotated tags
+func updateInfoRefs(patch *rootPatch, refs map[string]string) error {
+	var names []string
+	for ref := range refs {
+		if ref != "HEAD" && !strings.HasSuffix(ref, peeledSuffix) {
+			names = append(names, ref)
+		}
+	}
+	sort.Strings(names)
+	var infoRefs bytes.Buffer
+	for _, ref := range names {
+		sha1 := refs[ref]
+		fmt.Fprintf(&infoRefs, "%s\t%s\n", sha1, ref)
+		peeled, err := gitPeel(sha1)
 		if err != nil {
-			return errors.Wrapf(err, "patchLink failed")
+			// not fetched, keep what the remote said about it
+			log.Log("err", err, "ref", ref, "msg", "peeling failed")
+			peeled = refs[ref+peeledSuffix]
+		}
+		if peeled != "" && peeled != sha1 {
+			fmt.Fprintf(&infoRefs, "%s\t%s%s\n", peeled, ref, peeledSuffix)
 		}
-		root = newRoot
-		log.Log("newRoot", newRoot, "sha1", sha1, "msg", "updated object")
 	}
-	srcSha1, err := gitRefHash(src)
+	mhash, size, err := backend.Add(&infoRefs, options.dryRun)
 	if err != nil {
-		return errors.Wrapf(err, "gitRefHash(%s) failed", src)
+		return errors.Wrap(err, "updateInfoRefs: add failed")
 	}
-	h, ok := ref2hash[dst]
-	if !ok {
-		return errors.Errorf("writeRef: ref2hash entry missing: %s %+v", dst, ref2hash)
+	patch.addLink("info/refs", mhash, size)
+	return nil
+}
+
+// updateHead points HEAD to master, or else the first branch, if it is missing or names a branch that doesn't exist
+func updateHead(patch *rootPatch, refs map[string]string) error {
+	headRef, err := remoteHead(patch)
+	if err != nil {
+		return err
 	}
-	isFF := gitIsAncestor(h, srcSha1)
-	if isFF != nil && !force {
-		// TODO: print "non-fast-forward" to git
-		return errors.Errorf("non-fast-forward")
+	if _, ok := refs[headRef]; ok {
+		return nil
 	}
-	mhash, err := ipfsShell.Add(bytes.NewBufferString(fmt.Sprintf("%s\n", srcSha1)))
+	if headRef != "" {
+		log.Log("head", headRef, "msg", "HEAD points to a missing ref")
+	}
+	var branches []string
+	for ref := range refs {
+		if strings.HasPrefix(ref, "refs/heads/") {
+			branches = append(branches, ref)
+		}
+	}
+	if len(branches) == 0 {
+		return nil
+	}
+	sort.Strings(branches)
+	headRef = branches[0]
+	if _, ok := refs["refs/heads/master"]; ok {
+		headRef = "refs/heads/master"
+	}
+	mhash, size, err := backend.Add(strings.NewReader("ref: "+headRef+"\n"), options.dryRun)
 	if err != nil {
-		return errors.Wrapf(err, "shell.Add(%s) failed", srcSha1)
+		return errors.Wrap(err, "updateHead: add failed")
 	}
-	root, err = ipfsShell.PatchLink(root, dst, mhash, true)
+	patch.addLink("HEAD", mhash, size)
+	log.Log("head", headRef, "msg", "updated HEAD")
+	return nil
+}
+
+// remoteHead returns the ref HEAD of the remote points to, empty if there is no HEAD
+func remoteHead(patch *rootPatch) (string, error) {
+	head, err := readRootFile(patch, "HEAD")
 	if err != nil {
-		// TODO:print "fetch first" to git
-		err = errors.Wrapf(err, "patchLink(%s) failed", ipfsRepoPath)
-		log.Log("err", err, "msg", "shell.PatchLink failed")
-		return errors.Errorf("fetch first")
+		return "", err
 	}
-	log.Log("newRoot", root, "dst", dst, "hash", srcSha1, "msg", "updated ref")
-	// invalidate info/refs and HEAD(?)
-	// TODO: unclean: need to put other revs, too make a soft git update-server-info maybe
-	noInfoRefsHash, err := ipfsShell.Patch(root, "rm-link", "info/refs")
-	if err == nil {
-		log.Log("newRoot", noInfoRefsHash, "msg", "rm-link'ed info/refs")
-		root = noInfoRefsHash
-	} else {
-		// todo shell.IsNotExists() ?
-		log.Log("err", err, "msg", "shell.Patch rm-link info/refs failed - might be okay... TODO")
+	return strings.TrimSpace(strings.TrimPrefix(string(head), "ref: ")), nil
+}
+
+// remoteRef returns the sha1 of ref in the root of patch, "" if it doesn't exist there
+func remoteRef(patch *rootPatch, ref string) (string, error) {
+	loose, err := readRootFile(patch, ref)
+	if err != nil {
+		return "", err
 	}
-	newRemoteURL := fmt.Sprintf("ipfs:///ipfs/%s", root)
-	updateRepoCMD := exec.Command("git", "remote", "set-url", thisGitRemote, newRemoteURL)
-	out, err := updateRepoCMD.CombinedOutput()
+	if loose != nil {
+		sha1 := strings.TrimSpace(string(loose))
+		if !isSha1(sha1) {
+			return "", errors.Errorf("illegal sha1 %q in %s", sha1, ref)
+		}
+		return sha1, nil
+	}
+	packed, err := readRootFile(patch, "packed-refs")
 	if err != nil {
-		return errors.Wrapf(err, "updating remote url failed\nOut:%s", string(out))
+		return "", err
 	}
-	log.Log("msg", "remote updated", "address", newRemoteURL)
+	s := bufio.NewScanner(bytes.NewReader(packed))
+	for s.Scan() {
+		// "<sha1> <ref>", comments and peeled "^<sha1>" lines don't match
+		if fields := strings.Fields(s.Text()); len(fields) == 2 && fields[1] == ref {
+			if !isSha1(fields[0]) {
+				return "", errors.Errorf("illegal sha1 %q for %s in packed-refs", fields[0], ref)
+			}
+			return fields[0], nil
+		}
+	}
+	return "", s.Err()
+}
+
+// removePackedRef drops ref and its peeled line from packed-refs, if the remote has one
+func removePackedRef(patch *rootPatch, ref string) error {
+	packed, err := readRootFile(patch, "packed-refs")
+	if err != nil || packed == nil {
+		return err
+	}
+	var (
+		kept    bytes.Buffer
+		removed bool
+		inRef   bool
+	)
+	s := bufio.NewScanner(bytes.NewReader(packed))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "^") {
+			// peeled tag line, belongs to the ref before it
+			if !inRef {
+				fmt.Fprintln(&kept, line)
+			}
+			continue
+		}
+		inRef = strings.HasSuffix(line, " "+ref)
+		if inRef {
+			removed = true
+			continue
+		}
+		fmt.Fprintln(&kept, line)
+	}
+	if err := s.Err(); err != nil {
+		return errors.Wrap(err, "removePackedRef: scanning packed-refs failed")
+	}
+	if !removed {
+		return nil
+	}
+	mhash, size, err := backend.Add(&kept, options.dryRun)
+	if err != nil {
+		return errors.Wrap(err, "removePackedRef: add failed")
+	}
+	patch.addLink("packed-refs", mhash, size)
+	return nil
+}
+
+// readRootFile returns the content of the file p in the repo, nil if it doesn't exist
+func readRootFile(patch *rootPatch, p string) ([]byte, error) {
+	dir, name := path.Split(p)
+	names, err := patch.names(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", dir)
+	}
+	if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+		return nil, nil
+	}
+	rc, err := backend.Cat(path.Join(patch.root, p))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cat %s failed", p)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s failed", p)
+	}
+	return data, nil
+}
+
+// updateInfoPacks writes objects/info/packs for the packs under objects/pack, like git update-server-info does
+func updateInfoPacks(patch *rootPatch) error {
+	names, err := patch.names("objects/pack")
+	if err != nil {
+		return errors.Wrap(err, "updateInfoPacks: listing packs failed")
+	}
+	var infoPacks bytes.Buffer
+	for _, name := range names {
+		if strings.HasSuffix(name, ".pack") {
+			fmt.Fprintf(&infoPacks, "P %s\n", name)
+		}
+	}
+	fmt.Fprintln(&infoPacks)
+	mhash, size, err := backend.Add(&infoPacks, options.dryRun)
+	if err != nil {
+		return errors.Wrap(err, "updateInfoPacks: add failed")
+	}
+	patch.addLink("objects/info/packs", mhash, size)
 	return nil
 }
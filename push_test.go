@@ -10,7 +10,8 @@ import (
 
 func TestPush(t *testing.T) {
 	// $ git clone ipfs://ipfs/$hash/repo.git $tmpDir
-	startURL := "ipfs://ipfs/QmZhuM4TxuhxbamPtWHyHYCUXfkqCkgBmWREKF2kqTLbvz/unpackedTest"
+	startURL, done := seedTestRepo(t, false)
+	defer done()
 	tmpDir := cloneAndCheckout(t, startURL, expectedClone)
 
 	// $ cd repo && make $stuff
@@ -46,16 +47,17 @@ func TestPush(t *testing.T) {
 	rmDir(t, tmpDir)
 
 	var expectedClone = map[string]string{
-		"testA":     "9417d011822b875da72221c8d188089cbfcee806",
-		"hello.txt": "e2839ad2e47386d342038958fba941fc78e3780e",
-		"notes":     "32ed91604b272860ec911fc2bf4ae631b7900aa8",
+		"testA":     "9aec625e2471618b835367451c739be57a1b326f",
+		"hello.txt": "60fde9c2310b0d4cad4dab8d126b04387efba289",
+		"notes":     "1569f45c40cb40d0edb177110adc9482f5bc5813",
 		"newFile":   "cc7aae22f2d4301b6006e5f26e28b63579b61072",
 	}
 	rmDir(t, cloneAndCheckout(t, newURL, expectedClone))
 }
 
 func TestPush_twice(t *testing.T) {
-	startURL := "ipfs://ipfs/QmZhuM4TxuhxbamPtWHyHYCUXfkqCkgBmWREKF2kqTLbvz/unpackedTest"
+	startURL, done := seedTestRepo(t, false)
+	defer done()
 	tmpDir := cloneAndCheckout(t, startURL, expectedClone)
 
 	checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, "newFile"), []byte("Hello From Test"), 0700))
@@ -117,11 +119,242 @@ func TestPush_twice(t *testing.T) {
 	}
 
 	var expectedClone = map[string]string{
-		"testA":      "9417d011822b875da72221c8d188089cbfcee806",
-		"hello.txt":  "e2839ad2e47386d342038958fba941fc78e3780e",
-		"notes":      "32ed91604b272860ec911fc2bf4ae631b7900aa8",
+		"testA":      "9aec625e2471618b835367451c739be57a1b326f",
+		"hello.txt":  "60fde9c2310b0d4cad4dab8d126b04387efba289",
+		"notes":      "1569f45c40cb40d0edb177110adc9482f5bc5813",
 		"newFile":    "cc7aae22f2d4301b6006e5f26e28b63579b61072",
 		"2ndNewFile": "bacbe054a5fc6654bac497e36b474cd6839e3616",
 	}
 	rmDir(t, cloneAndCheckout(t, nextURL, expectedClone))
 }
+
+func TestPush_newRepo(t *testing.T) {
+	defer useTestStore(t)()
+	startURL := "ipfs://ipfs/" + emptyDirCid + "/repo.git"
+	tmpDir := mkRandTmpDir(t)
+	gitIn(t, tmpDir, "init")
+	checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, "newFile"), []byte("Hello From Test"), 0700))
+	gitIn(t, tmpDir, "add", "newFile")
+	gitIn(t, tmpDir, "commit", "-m", "test: first commit")
+
+	// the repo below the empty directory doesn't exist yet
+	gitIn(t, tmpDir, "remote", "add", "origin", startURL)
+	gitIn(t, tmpDir, "push", "origin", "HEAD:refs/heads/master")
+
+	newURL := gitIn(t, tmpDir, "config", "--get", "remote.origin.url")
+	if newURL == startURL {
+		t.Fatalf("remote url wasn't updated. is:%q", newURL)
+	}
+	rmDir(t, tmpDir)
+
+	rmDir(t, cloneAndCheckout(t, newURL, map[string]string{
+		"newFile": "cc7aae22f2d4301b6006e5f26e28b63579b61072",
+	}))
+}
+
+// TestPush_store pushes to the same store twice and clones from it
+func TestPush_store(t *testing.T) {
+	defer useTestStore(t)()
+	tmpDir := mkRandTmpDir(t)
+	gitIn(t, tmpDir, "init")
+	checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, "newFile"), []byte("Hello From Test"), 0700))
+	gitIn(t, tmpDir, "add", "newFile")
+	gitIn(t, tmpDir, "commit", "-m", "test: first commit")
+	gitIn(t, tmpDir, "remote", "add", "origin", "ipfs://ipfs/"+emptyDirCid+"/repo.git")
+	gitIn(t, tmpDir, "push", "origin", "HEAD:refs/heads/master")
+	checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, "newFile"), []byte("Hello again"), 0700))
+	gitIn(t, tmpDir, "commit", "-a", "-m", "test: second commit")
+	gitIn(t, tmpDir, "push", "origin", "HEAD:refs/heads/master")
+	newURL := gitIn(t, tmpDir, "config", "--get", "remote.origin.url")
+	rmDir(t, tmpDir)
+
+	rmDir(t, cloneAndCheckout(t, newURL, map[string]string{
+		"newFile": "43ce0c8e7e28680735241ad3e5550aa361b96f53",
+	}))
+}
+
+func TestPush_newRefs(t *testing.T) {
+	startURL, done := seedTestRepo(t, false)
+	defer done()
+	tmpDir := cloneAndCheckout(t, startURL, expectedClone)
+
+	gitIn(t, tmpDir, "checkout", "-b", "feature")
+	checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, "newFile"), []byte("Hello From Test"), 0700))
+	gitIn(t, tmpDir, "add", "newFile")
+	gitIn(t, tmpDir, "commit", "-m", "test: feature commit")
+	gitIn(t, tmpDir, "tag", "-a", "-m", "test: tag", "v1.0")
+	gitIn(t, tmpDir, "push", "origin", "feature", "v1.0")
+
+	newURL := gitIn(t, tmpDir, "config", "--get", "remote.origin.url")
+	if newURL == startURL {
+		t.Fatalf("remote url wasn't updated. is:%q", newURL)
+	}
+	want := gitIn(t, tmpDir, "rev-parse", "feature")
+	lsRemote := gitIn(t, tmpDir, "ls-remote", newURL)
+	for _, ref := range []string{"refs/heads/feature", "refs/tags/v1.0^{}"} {
+		if !strings.Contains(lsRemote, want+"\t"+ref) {
+			t.Errorf("%s missing in ls-remote output:\n%s", ref, lsRemote)
+		}
+	}
+	rmDir(t, tmpDir)
+}
+
+func TestPush_delete(t *testing.T) {
+	startURL, done := seedTestRepo(t, false)
+	defer done()
+	tmpDir := cloneAndCheckout(t, startURL, expectedClone)
+
+	gitIn(t, tmpDir, "push", "origin", "HEAD:refs/heads/doomed")
+	if lsRemote := gitIn(t, tmpDir, "ls-remote", "origin"); !strings.Contains(lsRemote, "refs/heads/doomed") {
+		t.Fatalf("branch wasn't created:\n%s", lsRemote)
+	}
+	gitIn(t, tmpDir, "push", "origin", ":doomed")
+	if lsRemote := gitIn(t, tmpDir, "ls-remote", "origin"); strings.Contains(lsRemote, "refs/heads/doomed") {
+		t.Errorf("branch wasn't deleted:\n%s", lsRemote)
+	}
+
+	// HEAD points to master
+	cmd := exec.Command(gitPath, "push", "origin", ":master")
+	cmd.Dir = tmpDir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("deleted the current branch:\n%s", out)
+	}
+	rmDir(t, tmpDir)
+}
+
+func TestPush_atomic(t *testing.T) {
+	startURL, done := seedTestRepo(t, false)
+	defer done()
+	tmpDir := cloneAndCheckout(t, startURL, expectedClone)
+
+	checkFatal(t, ioutil.WriteFile(filepath.Join(tmpDir, "newFile"), []byte("Hello From Test"), 0700))
+	gitIn(t, tmpDir, "add", "newFile")
+	gitIn(t, tmpDir, "commit", "-m", "test: Add newFile Commit")
+	gitIn(t, tmpDir, "push", "origin", "HEAD:refs/heads/behind")
+	pushedURL := gitIn(t, tmpDir, "config", "--get", "remote.origin.url")
+
+	// behind can't be fast-forwarded to HEAD~1, so ahead must not be created either
+	cmd := exec.Command(gitPath, "push", "--atomic", "origin", "HEAD~1:refs/heads/behind", "HEAD:refs/heads/ahead")
+	cmd.Dir = tmpDir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("non-fast-forward push succeeded:\n%s", out)
+	}
+	if newURL := gitIn(t, tmpDir, "config", "--get", "remote.origin.url"); newURL != pushedURL {
+		t.Errorf("remote url changed by a failed push: %q", newURL)
+	}
+	if lsRemote := gitIn(t, tmpDir, "ls-remote", "origin"); strings.Contains(lsRemote, "refs/heads/ahead") {
+		t.Errorf("ahead was created:\n%s", lsRemote)
+	}
+
+	// both at once, with a single new root
+	gitIn(t, tmpDir, "push", "--atomic", "origin", "HEAD:refs/heads/ahead", "HEAD:refs/heads/other")
+	lsRemote := gitIn(t, tmpDir, "ls-remote", "origin")
+	for _, ref := range []string{"refs/heads/ahead", "refs/heads/other"} {
+		if !strings.Contains(lsRemote, ref) {
+			t.Errorf("%s missing in ls-remote output:\n%s", ref, lsRemote)
+		}
+	}
+	rmDir(t, tmpDir)
+}
+
+func TestCheckPushRefs(t *testing.T) {
+	var err error
+	gitPath, err = exec.LookPath("git")
+	checkFatal(t, err)
+	tmpDir := mkRandTmpDir(t)
+	gitIn(t, tmpDir, "init")
+	gitIn(t, tmpDir, "config", "user.email", "test@example.com")
+	gitIn(t, tmpDir, "config", "user.name", "test")
+	gitIn(t, tmpDir, "commit", "--allow-empty", "-m", "test: first")
+	gitIn(t, tmpDir, "commit", "--allow-empty", "-m", "test: second")
+	first := gitIn(t, tmpDir, "rev-parse", "HEAD~1")
+	second := gitIn(t, tmpDir, "rev-parse", "HEAD")
+	tree := gitIn(t, tmpDir, "rev-parse", "HEAD^{tree}")
+
+	oldRepo, oldRefs, oldCAS, oldBackend := thisGitRepo, ref2hash, options.cas, backend
+	thisGitRepo = filepath.Join(tmpDir, ".git")
+	ref2hash = map[string]string{
+		"refs/heads/ahead":  second,
+		"refs/heads/behind": first,
+		"refs/heads/gone":   "0123456789abcdef0123456789abcdef01234567",
+		"refs/heads/tree":   tree,
+		"refs/tags/v1":      first,
+		// outdated, the lease is checked against the root
+		"refs/heads/moved": first,
+	}
+	options.cas = map[string]string{
+		"refs/heads/leased": "",
+		"refs/heads/stale":  second,
+		"refs/heads/moved":  second,
+	}
+	s := newBlockStore("")
+	backend = s
+	moved := mustAdd(t, s, second+"\n")
+	movedSize, err := s.Size(moved)
+	checkFatal(t, err)
+	// a repo without HEAD that only has the moved ref
+	rp := newRootPatch(emptyDirCid)
+	rp.addLink("refs/heads/moved", moved, movedSize)
+	root, err := rp.apply()
+	checkFatal(t, err)
+	defer func() {
+		thisGitRepo, ref2hash, options.cas, backend = oldRepo, oldRefs, oldCAS, oldBackend
+		localObjects.Lock()
+		if localObjects.in != nil {
+			localObjects.in.Close()
+			localObjects.in = nil
+		}
+		localObjects.Unlock()
+		rmDir(t, tmpDir)
+	}()
+
+	cases := []struct {
+		spec, update, err string
+	}{
+		{first + ":refs/heads/ahead", "", "non-fast-forward"},
+		{"+" + first + ":refs/heads/ahead", "forced", ""},
+		{second + ":refs/heads/behind", "fast-forward", ""},
+		{second + ":refs/heads/gone", "", "fetch first"},
+		{"+" + second + ":refs/heads/gone", "forced", ""},
+		{second + ":refs/heads/tree", "", "needs force"},
+		{second + ":refs/tags/v1", "", "already exists"},
+		{second + ":refs/heads/new", "created", ""},
+		{"+" + second + ":refs/heads/leased", "created", ""},
+		{"+" + second + ":refs/heads/stale", "", "stale info"},
+		// like git sends --force-with-lease
+		{second + ":refs/heads/leased", "created", ""},
+		{second + ":refs/heads/stale", "", "stale info"},
+		{first + ":refs/heads/moved", "forced", ""},
+		{":refs/heads/behind", "deleted", ""},
+		{":refs/heads/missing", "deleted", "remote ref does not exist"},
+	}
+	var refs []*pushRef
+	for _, tc := range cases {
+		r, err := parsePushRef(tc.spec)
+		checkFatal(t, err)
+		refs = append(refs, r)
+	}
+	checkFatal(t, checkPushRefs(newRootPatch(root), refs))
+	for i, tc := range cases {
+		r := refs[i]
+		var errMsg string
+		if r.err != nil {
+			errMsg = r.err.Error()
+		}
+		if r.update != tc.update || errMsg != tc.err {
+			t.Errorf("%s: got %q %q, want %q %q", tc.spec, r.update, errMsg, tc.update, tc.err)
+		}
+	}
+}
+
+// gitIn runs git in dir and returns the trimmed stdout
+func gitIn(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	t.Logf("git %v out: %s%s", args, out, stderr.String())
+	checkFatal(t, err)
+	return strings.TrimSpace(string(out))
+}